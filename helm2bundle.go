@@ -2,276 +2,3495 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-const dockerfileTemplate string = `FROM ansibleplaybookbundle/helm-bundle-base
+// defaultBaseImage is the image that generated Dockerfiles build FROM unless
+// --base-image chooses another.
+const defaultBaseImage string = "ansibleplaybookbundle/helm-bundle-base"
+
+const dockerfileTemplate string = `FROM {{.BaseImage}}
 
 LABEL "com.redhat.apb.spec"=\
-""
+"{{.EncodedSpec}}"
+{{with .Provenance}}
+LABEL {{if .Created}}"org.opencontainers.image.created"="{{labelValue .Created}}" \
+      {{end}}"org.opencontainers.image.version"="{{labelValue .Version}}"{{if .Source}} \
+      "org.opencontainers.image.source"="{{labelValue .Source}}"{{end}}
+{{end}}
+{{if .Workdir}}WORKDIR {{.Workdir}}
 
-COPY {{.TarfileName}} /opt/chart.tgz
+{{end}}{{if .ChartBuildArg}}ARG CHART_TGZ
+COPY{{if .ChartOwner}} --chown={{.ChartOwner}}{{end}} ${CHART_TGZ} {{.ChartDest}}{{else}}COPY{{if .ChartOwner}} --chown={{.ChartOwner}}{{end}} {{.TarfileName}} {{.ChartDest}}{{end}}
 
 ENTRYPOINT ["entrypoint.sh"]
 `
 
+// buildScriptTemplate renders the build.sh written by --with-build-script.
+// Like --build, it uses the first of containerRuntimes that is installed
+// unless RUNTIME is set.
+const buildScriptTemplate string = `#!/bin/sh
+# Builds the service bundle image from the files that helm2bundle generated
+# next to this script.
+set -e
+cd "$(dirname "$0")"
+
+if [ -z "$RUNTIME" ]; then
+	for candidate in {{runtimes}}; do
+		if command -v "$candidate" >/dev/null 2>&1; then
+			RUNTIME=$candidate
+			break
+		fi
+	done
+fi
+if [ -z "$RUNTIME" ]; then
+	echo "no container runtime found (tried {{runtimes}}); set RUNTIME to choose one" >&2
+	exit 1
+fi
+TAG=${TAG:-{{shellQuote .ImageTag}}}
+
+"$RUNTIME" build -t "$TAG" -f {{shellQuote .DockerfileName}}{{if .ChartBuildArg}} --build-arg CHART_TGZ={{shellQuote .TarfileName}}{{end}} .
+echo "built $TAG; push it to a registry that your broker can access, or use \"apb push\" on OpenShift"
+`
+
+// version is the release of helm2bundle, which can be set at build time with
+// -ldflags "-X main.version=...".
+var version = "unreleased"
+
+// chartOwnerPattern matches the USER[:GROUP] argument of COPY --chown, where
+// each part is a name or a numeric ID.
+var chartOwnerPattern = regexp.MustCompile(`^([a-z_][a-z0-9_-]*|[0-9]+)(:([a-z_][a-z0-9_-]*|[0-9]+))?$`)
+
+// dnsLabelPattern matches a DNS label, which is what APB tooling requires a
+// bundle name to be. Labels are also limited to 63 characters.
+var dnsLabelPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// gzipMagic is the leading bytes of a gzip stream.
+const gzipMagic string = "\x1f\x8b"
+
+// zipMagic is the leading bytes of a zip archive's first local file header.
+const zipMagic string = "PK\x03\x04"
+
+// bundleCRAPIVersion and bundleCRKind identify the custom resource that a
+// broker watches for bundles registered in the cluster.
+const bundleCRAPIVersion string = "automationbroker.io/v1alpha1"
+const bundleCRKind string = "Bundle"
+
+// defaultValuesName is the file at the chart root that supplies default values
+// unless --values-name chooses another.
+const defaultValuesName string = "values.yaml"
+
+// descriptionSourceChart and descriptionSourceReadme are the allowed values of
+// --description-source.
+const descriptionSourceChart string = "chart"
+const descriptionSourceReadme string = "readme"
+
+// overwriteConfirmEnv is the environment variable that must be set to "yes"
+// for --force to take effect when --require-overwrite-confirmation is given.
+const overwriteConfirmEnv string = "HELM2BUNDLE_CONFIRM_OVERWRITE"
+
+// defaultMaxDecompressedSize is the default limit on how large a chart archive
+// may be once decompressed, which guards against decompression bombs.
+const defaultMaxDecompressedSize int64 = 100 * 1024 * 1024
+
+// defaultMaxFileSize is the default limit on how large each file read from a
+// chart may be.
+const defaultMaxFileSize int64 = 10 * 1024 * 1024
+
+// valuesSchemaName is the JSON Schema file that helm 3 charts may include to
+// describe their values.
+const valuesSchemaName string = "values.schema.json"
+
+// requirementsName is the file in which Helm 2 charts declare their
+// dependencies.
+const requirementsName string = "requirements.yaml"
+
+// defaultChartDest is where the base image expects to find the chart.
+const defaultChartDest string = "/opt/chart.tgz"
+
 const apbYml string = "apb.yml"
+const apbJSON string = "apb.json"
 const dockerfile string = "Dockerfile"
+const buildScript string = "build.sh"
+
+// formatYAML and formatJSON are the formats the spec file can be written in.
+const formatYAML string = "yaml"
+const formatJSON string = "json"
 
 // APB represents an apb.yml file
 type APB struct {
-	Version     string            `yaml:"version"`
-	Name        string            `yaml:"name"`
-	Description string            `yaml:"description"`
-	Bindable    bool              `yaml:"bindable"`
-	Async       string            `yaml:"async"`
-	Metadata    map[string]string `yaml:"metadata"`
-	Plans       []Plan            `yaml:"plans"`
+	Version     string                 `yaml:"version" json:"version"`
+	Name        string                 `yaml:"name" json:"name"`
+	Description string                 `yaml:"description" json:"description"`
+	Bindable    bool                   `yaml:"bindable" json:"bindable"`
+	Async       string                 `yaml:"async" json:"async"`
+	Metadata    map[string]interface{} `yaml:"metadata" json:"metadata"`
+	Plans       []Plan                 `yaml:"plans" json:"plans"`
 }
 
 type Plan struct {
-	Name        string                 `yaml:"name"`
-	Description string                 `yaml:"description"`
-	Free        bool                   `yaml:"free"`
-	Metadata    map[string]interface{} `yaml:"metadata"`
-	Parameters  []Parameter            `yaml:"parameters"`
+	Name        string                 `yaml:"name" json:"name"`
+	Description string                 `yaml:"description" json:"description"`
+	Free        bool                   `yaml:"free" json:"free"`
+	Metadata    map[string]interface{} `yaml:"metadata" json:"metadata"`
+	Parameters  []Parameter            `yaml:"parameters" json:"parameters"`
 }
 
 type Parameter struct {
-	Name        string `yaml:"name"`
-	Title       string `yaml:"title"`
-	Type        string `yaml:"type"`
-	DisplayType string `yaml:"display_type"`
-	Default     string `yaml:"default"`
+	Name        string        `yaml:"name" json:"name"`
+	Title       string        `yaml:"title" json:"title"`
+	Type        string        `yaml:"type" json:"type"`
+	DisplayType string        `yaml:"display_type,omitempty" json:"display_type,omitempty"`
+	Default     interface{}   `yaml:"default" json:"default"`
+	Pattern     string        `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	Enum        []interface{} `yaml:"enum,omitempty" json:"enum,omitempty"`
+	Required    bool          `yaml:"required,omitempty" json:"required,omitempty"`
 }
 
 // NewAPB returns a pointer to a new APB that has been populated with the
 // passed-in data.
 func NewAPB(v TarValues) *APB {
-	parameter := Parameter{
-		Name:        "values",
-		Title:       "Values",
-		Type:        "string",
-		DisplayType: "textarea",
-		Default:     v.Values,
-	}
-	plan := Plan{
-		Name:        "default",
-		Description: fmt.Sprintf("Deploys helm chart %s", v.Name),
-		Free:        true,
-		Metadata:    make(map[string]interface{}),
-		Parameters:  []Parameter{parameter},
+	name := v.Name
+	if len(v.BundleName) > 0 {
+		name = v.BundleName
+	}
+	async := v.Async
+	if len(async) == 0 {
+		async = "optional"
+	}
+	planDescription := v.PlanDescription
+	if len(planDescription) == 0 {
+		planDescription = fmt.Sprintf("Deploys helm chart %s", v.Name)
+		if v.Bindable {
+			planDescription += "; supports binding"
+		}
+	}
+	planName := v.PlanName
+	if len(planName) == 0 {
+		planName = "default"
+	}
+	defaultPlan := newPlan(planName, planDescription, v.Values, v.Parameters)
+	defaultPlan.Free = !v.Paid
+	plans := []Plan{defaultPlan}
+	for _, extra := range v.Plans {
+		description := fmt.Sprintf("Deploys helm chart %s with %s values", v.Name, extra.Name)
+		plans = append(plans, newPlan(extra.Name, description, extra.Values, extra.Parameters))
 	}
 	apb := APB{
-		Version:     "1.0",
-		Name:        fmt.Sprintf("%s-apb", v.Name),
+		Version:     "1.0", // the APB spec format version, which the broker validates; the chart version goes in metadata
+		Name:        fmt.Sprintf("%s-apb", name),
 		Description: v.Description,
-		Bindable:    false,
-		Async:       "optional",
-		Metadata: map[string]string{
-			"displayName":                    fmt.Sprintf("%s (helm bundle)", v.Name),
+		Bindable:    v.Bindable,
+		Async:       async,
+		Metadata: map[string]interface{}{
+			"displayName":                    fmt.Sprintf("%s (helm bundle)", name),
 			"console.openshift.io/iconClass": fmt.Sprintf("icon-%s", v.Name), // no guarantee it exists, but worth a shot
 		},
-		Plans: []Plan{plan},
+		Plans: plans,
+	}
+	if len(v.Tags) > 0 {
+		apb.Metadata["tags"] = v.Tags
+	}
+	imageURL := v.Chart.Icon
+	if len(v.ImageURL) > 0 {
+		imageURL = v.ImageURL
+	}
+	if len(imageURL) > 0 {
+		apb.Metadata["imageUrl"] = imageURL
+	}
+	if len(v.Chart.APIVersion) > 0 {
+		apb.Metadata["chartApiVersion"] = v.Chart.APIVersion
+	}
+	if len(v.Chart.Version) > 0 {
+		apb.Metadata["chartVersion"] = v.Chart.Version
+	}
+	if len(v.Chart.AppVersion) > 0 {
+		apb.Metadata["appVersion"] = v.Chart.AppVersion
+	}
+	if len(v.Chart.KubeVersion) > 0 {
+		apb.Metadata["kubeVersion"] = v.Chart.KubeVersion
+	}
+	if len(v.Chart.Maintainers) > 0 {
+		apb.Metadata["maintainers"] = v.Chart.Maintainers
+	}
+	if len(v.Dependencies) > 0 {
+		apb.Metadata["dependencies"] = v.Dependencies
 	}
 	return &apb
 }
 
+// newPlan returns a free plan that deploys the chart with the given default
+// values. They are offered as a single "values" parameter unless parameters
+// were generated from them.
+func newPlan(name, description, values string, parameters []Parameter) Plan {
+	if len(parameters) == 0 {
+		parameters = []Parameter{{
+			Name:        "values",
+			Title:       "Values",
+			Type:        "string",
+			DisplayType: "textarea",
+			Default:     values,
+			Required:    true,
+		}}
+	}
+	return Plan{
+		Name:        name,
+		Description: description,
+		Free:        true,
+		Metadata:    make(map[string]interface{}),
+		Parameters:  parameters,
+	}
+}
+
+// BundleCR is a Kubernetes custom resource that wraps an APB so it can be
+// registered with "kubectl apply" instead of through an image label.
+type BundleCR struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   map[string]string `yaml:"metadata"`
+	Spec       *APB              `yaml:"spec"`
+}
+
+// NewBundleCR returns a pointer to a new BundleCR whose spec is the APB
+// generated from the passed-in data.
+func NewBundleCR(v TarValues) *BundleCR {
+	apb := NewAPB(v)
+	return &BundleCR{
+		APIVersion: bundleCRAPIVersion,
+		Kind:       bundleCRKind,
+		Metadata:   map[string]string{"name": apb.Name},
+		Spec:       apb,
+	}
+}
+
 // TarValues holds data that will be used to create the Dockerfile and apb.yml
 type TarValues struct {
-	Name        string
-	Description string
-	TarfileName string
-	Values      string // the entire contents of the chart's values.yaml file
+	Name         string
+	Description  string
+	TarfileName  string
+	Values       string   // the entire contents of the chart's values.yaml file
+	ChartYaml    string   // the entire contents of the chart's Chart.yaml file
+	Readme       string   // the chart's README.md, when it was requested
+	Schema       string   // the chart's values.schema.json, when it was requested
+	Requirements string   // the chart's requirements.yaml, when dependencies were requested
+	Subcharts    []string // the charts bundled in the chart's charts/ directory
+	Chart        Chart    // everything parsed from the chart's Chart.yaml file
+
+	// BaseImage is the image that the Dockerfile builds FROM.
+	BaseImage string
+
+	// EncodedSpec is the base64-encoded apb.yml document embedded in the
+	// Dockerfile's com.redhat.apb.spec label. writeDockerfile fills it in.
+	EncodedSpec string
+
+	// ChartBuildArg makes the Dockerfile COPY the chart named by the
+	// CHART_TGZ build arg instead of TarfileName.
+	ChartBuildArg bool
+
+	// PlanDescription, when not empty, replaces the generated description of
+	// the default plan.
+	PlanDescription string
+
+	// Workdir, when not empty, is set as the Dockerfile's WORKDIR.
+	Workdir string
+
+	// ChartDest is where the Dockerfile copies the chart to in the image.
+	ChartDest string
+
+	// ChartOwner, when not empty, is the USER[:GROUP] that owns the chart
+	// copied into the image.
+	ChartOwner string
+
+	// OmitEmpty leaves null and empty fields out of the rendered spec.
+	OmitEmpty bool
+
+	// Format is how the spec file is written, yaml or json. The spec embedded
+	// in the Dockerfile is always yaml.
+	Format string
+
+	// Bindable marks the bundle as one that services can bind to.
+	Bindable bool
+
+	// Async, when not empty, is whether the bundle runs asynchronously:
+	// required, optional or unsupported. The default is optional.
+	Async string
+
+	// DockerfileName is the name of the generated Dockerfile, for the build
+	// script.
+	DockerfileName string
+
+	// ImageTag is what the bundle image is tagged when it is built.
+	ImageTag string
+
+	// Spec, when not nil, is written instead of the APB generated from the
+	// rest of these values.
+	Spec *APB
+
+	// DockerfileTemplate, when not empty, is the text/template used to render
+	// the Dockerfile instead of the built-in one.
+	DockerfileTemplate string
+
+	// ImageURL, when not empty, is used for the bundle's icon instead of the
+	// chart's icon URL.
+	ImageURL string
+
+	// BundleName, when not empty, replaces the chart name in the bundle's
+	// name and display name.
+	BundleName string
+
+	// Dependencies, when not empty, are the chart's dependencies recorded in
+	// the bundle's metadata.
+	Dependencies []Dependency
+
+	// Parameters, when not empty, replace the single "values" parameter of
+	// the default plan.
+	Parameters []Parameter
+
+	// Tags are searchable catalog tags added to the bundle's metadata.
+	Tags []string
+
+	// Provenance, when not nil, is added to the Dockerfile as OCI annotation
+	// labels.
+	Provenance *Provenance
+
+	// PlanName, when not empty, replaces "default" as the name of the
+	// default plan.
+	PlanName string
+
+	// Paid marks the default plan as not free.
+	Paid bool
+
+	// Plans are additional plans offered alongside the default one.
+	Plans []PlanValues
+
+	// ExtraFiles holds the contents of other files read from the chart root
+	// by request, by name.
+	ExtraFiles map[string]string
+}
+
+// PlanValues holds the data for an additional plan, which deploys the chart
+// with a different set of default values.
+type PlanValues struct {
+	Name       string
+	File       string // the --plan FILE that Values was read from
+	Values     string
+	Parameters []Parameter // generated parameters; when empty, the plan's values are a single parameter
+}
+
+// Provenance describes how a bundle image was produced.
+type Provenance struct {
+	Created string // RFC 3339 time from SOURCE_DATE_EPOCH, or empty to leave it out
+	Version string // version of helm2bundle
+	Source  string // optional reference to the source of the chart
 }
 
 // Chart holds data that is parsed from a helm chart's Chart.yaml file.
 type Chart struct {
-	Description string
-	Name        string
+	APIVersion   string            `yaml:"apiVersion" json:"apiVersion"`
+	Description  string            `json:"description"`
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	AppVersion   string            `yaml:"appVersion" json:"appVersion"`
+	KubeVersion  string            `yaml:"kubeVersion" json:"kubeVersion"`
+	Icon         string            `json:"icon"`
+	Keywords     []string          `json:"keywords"`
+	Maintainers  []Maintainer      `json:"maintainers"`
+	Dependencies []Dependency      `json:"dependencies"`
+	Annotations  map[string]string `json:"annotations"`
 }
 
-func main() {
-	// forceArg is true when the user specifies --force, and it indicates that
-	// it is ok to replace existing files.
-	var forceArg bool
+// Maintainer is an entry in the maintainers list of a Chart.yaml file.
+type Maintainer struct {
+	Name  string `yaml:"name" json:"name"`
+	Email string `yaml:"email,omitempty" json:"email,omitempty"`
+	URL   string `yaml:"url,omitempty" json:"url,omitempty"`
+}
 
-	var rootCmd = &cobra.Command{
-		Use:   "helm2bundle CHARTFILE",
-		Short: "Packages a helm chart as a Service Bundle",
-		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			if forceArg == false {
-				// fail if one of the files already exists
-				exists, err := fileExists()
-				if err != nil {
-					fmt.Println(err.Error())
-					fmt.Println("could not get values from helm chart")
-					os.Exit(1)
-				}
-				if exists {
-					fmt.Printf("use --force to overwrite existing %s and/or %s\n", dockerfile, apbYml)
-					os.Exit(1)
-				}
+// Dependency is an entry in the dependencies list of a Chart.yaml file.
+type Dependency struct {
+	Name       string `yaml:"name" json:"name"`
+	Version    string `yaml:"version,omitempty" json:"version"`
+	Repository string `yaml:"repository,omitempty" json:"repository,omitempty"`
+}
+
+// chartDependencies returns every dependency of the chart, whether it is
+// declared in Chart.yaml, in requirements.yaml, or only bundled in charts/.
+func chartDependencies(v TarValues) ([]Dependency, error) {
+	deps := append([]Dependency(nil), v.Chart.Dependencies...)
+	if len(v.Requirements) > 0 {
+		var requirements struct {
+			Dependencies []Dependency `yaml:"dependencies"`
+		}
+		err := yaml.Unmarshal([]byte(v.Requirements), &requirements)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", requirementsName, err)
+		}
+		deps = append(deps, requirements.Dependencies...)
+	}
+	for _, sub := range v.Subcharts {
+		declared := false
+		for _, dep := range deps {
+			// packaged subcharts are named NAME-VERSION
+			if sub == dep.Name || strings.HasPrefix(sub, dep.Name+"-") {
+				declared = true
+				break
 			}
+		}
+		if !declared {
+			deps = append(deps, Dependency{Name: sub})
+		}
+	}
+	return deps, nil
+}
 
-			filename := args[0]
+// options holds the settings, taken from the command-line flags, that control
+// how a chart is converted.
+type options struct {
+	// force is true when the user specifies --force, and it indicates that
+	// it is ok to replace existing files.
+	force bool
 
-			values, err := getTarValues(filename)
-			if err != nil {
-				fmt.Println(err.Error())
-				fmt.Println("could not get values from helm chart")
-				os.Exit(1)
-			}
+	// requireConfirm is true when the user specifies
+	// --require-overwrite-confirmation, and it indicates that --force may only
+	// replace existing files when overwriteConfirmEnv is also set to "yes".
+	requireConfirm bool
 
-			err = writeApbYaml(values)
-			if err != nil {
-				fmt.Println(err.Error())
-				fmt.Println("could not render template")
-				os.Exit(1)
-			}
-			err = writeDockerfile(values)
-			if err != nil {
-				fmt.Println(err.Error())
-				fmt.Println("could not render template")
-				os.Exit(1)
-			}
-		},
+	// bestEffort is true when the user specifies --best-effort, and it
+	// indicates that a chart missing values.yaml or a name should still be
+	// converted using placeholder data.
+	bestEffort bool
+
+	// valuesName is the name of the file at the chart root whose contents
+	// become the default values.
+	valuesName string
+
+	// emitChartJSON is true when the user specifies --emit-chart-json, and
+	// it indicates that the parsed chart should be printed as JSON instead of
+	// generating a bundle.
+	emitChartJSON bool
+
+	// chartBuildArg is true when the user specifies --chart-build-arg, and
+	// it indicates that the Dockerfile should take the chart path from a
+	// build arg.
+	chartBuildArg bool
+
+	// helmVersion is the major version of helm used by the base image. When
+	// non-zero, a warning is shown if the chart was written for a different
+	// major version.
+	helmVersion int
+
+	// emitCR is true when the user specifies --emit-cr, and it indicates
+	// that a custom resource manifest should be printed instead of
+	// generating a bundle.
+	emitCR bool
+
+	// normalizeValues is true when the user specifies --normalize-values,
+	// and it indicates that values.yaml should be re-marshaled with
+	// consistent indentation before it is embedded.
+	normalizeValues bool
+
+	// mappingReport is true when the user specifies --mapping-report, and
+	// it indicates that a table showing where chart data landed in the bundle
+	// should be printed.
+	mappingReport bool
+
+	// noOCILabels is true when the user specifies --no-oci-labels, and it
+	// indicates that provenance labels should be left out of the Dockerfile.
+	noOCILabels bool
+
+	// sourceRef is recorded as the image source in the Dockerfile's
+	// provenance labels.
+	sourceRef string
+
+	// planDescription, when not empty, is used as the description of the
+	// default plan.
+	planDescription string
+
+	// planDescriptionFromChart is true when the user specifies
+	// --plan-description-from-chart, and it indicates that the chart's
+	// description should be used for the default plan when
+	// --plan-description is not given.
+	planDescriptionFromChart bool
+
+	// tagsAnnotation, when not empty, names a chart annotation holding a
+	// comma-separated list of tags to add to the catalog tags, which are
+	// otherwise the chart's keywords.
+	tagsAnnotation string
+
+	// omitEmpty is true when the user specifies --omit-empty, and it
+	// indicates that empty fields should be left out of the rendered spec.
+	omitEmpty bool
+
+	// bindable is true when the user specifies --bindable, and it
+	// indicates that the generated bundle should be marked bindable.
+	bindable bool
+
+	// name, when not empty, is used instead of the chart's name in the
+	// bundle's name and display name.
+	name string
+
+	// planName is the name of the default plan.
+	planName string
+
+	// free is true unless the user specifies --free=false, and it
+	// indicates whether the default plan is free.
+	free bool
+
+	// async is the value of the spec's async field.
+	async string
+
+	// embedIcon is true when the user specifies --embed-icon, and it
+	// indicates that the chart's icon should be downloaded and embedded in
+	// the spec as a data URI.
+	embedIcon bool
+
+	// allowAPIVersions are chart apiVersions that are converted even though
+	// helm2bundle does not recognize them.
+	allowAPIVersions []string
+
+	// dockerfileTemplate, when not empty, is a file containing the
+	// template to render the Dockerfile with.
+	dockerfileTemplate string
+
+	// merge is true when the user specifies --merge, and it indicates that
+	// an existing spec file should be updated with the chart's data rather
+	// than replaced.
+	merge bool
+
+	// verify is true when the user specifies --verify, and it indicates
+	// that the chart must match a signed provenance file next to it.
+	verify bool
+
+	// keyring is the public keyring that provenance signatures are
+	// checked against.
+	keyring string
+
+	// withBuildScript is true when the user specifies --with-build-script,
+	// and it indicates that a build.sh should be written next to the
+	// Dockerfile.
+	withBuildScript bool
+
+	// format is the format of the generated spec file, yaml or json.
+	format string
+
+	// build is true when the user specifies --build, and it indicates that
+	// the image should be built once the Dockerfile is written.
+	build bool
+
+	// tag, when not empty, is the tag given to the built image instead of
+	// the bundle name.
+	tag string
+
+	// runtime, when not empty, is the container runtime that builds the
+	// image instead of the detected one.
+	runtime string
+
+	// descriptionSource selects where the bundle's description comes from,
+	// either "chart" for Chart.yaml or "readme" for the chart's README.md.
+	descriptionSource string
+
+	// nameFiles is true when the user specifies --name-files, and it
+	// indicates that output files should be prefixed with the bundle name.
+	nameFiles bool
+
+	// timings is true when the user specifies --timings, and it indicates
+	// that the duration of each conversion phase should be logged.
+	timings bool
+
+	// outputDir is the directory where generated files are written. It is
+	// also the Dockerfile's build context. It may be a template that is
+	// expanded with the chart's data, such as "bundles/{{.Name}}".
+	outputDir string
+
+	// workdir, when not empty, is set as the WORKDIR of the Dockerfile.
+	workdir string
+
+	// chartOwner, when not empty, is the USER[:GROUP] passed to COPY
+	// --chown for the chart.
+	chartOwner string
+
+	// dryRun is true when the user specifies --dry-run, and it indicates
+	// that generated files should be printed to stdout instead of written.
+	dryRun bool
+
+	// contextCompress is true unless the user specifies
+	// --context-chart-compress=false, and it indicates whether the chart in
+	// the build context should be gzipped.
+	contextCompress bool
+
+	// chartDest is the path in the image that the chart is copied to.
+	chartDest string
+
+	// mergeValues are values files, in order, that are deep-merged over
+	// the chart's values to produce the embedded default.
+	mergeValues []string
+
+	// plans are LABEL=FILE pairs, each of which adds a plan whose default
+	// values are the contents of FILE.
+	plans []string
+
+	// maxDecompressedSize is the most bytes a chart archive may expand to
+	// while it is read, or 0 for no limit.
+	maxDecompressedSize int64
+
+	// maxFileSize is the most bytes that each file read from a chart may
+	// contain, or 0 for no limit.
+	maxFileSize int64
+
+	// expandParams is true when the user specifies --expand-params, and it
+	// indicates that each top-level key in values.yaml should become its own
+	// parameter.
+	expandParams bool
+
+	// baseImage is the image that the generated Dockerfile builds FROM.
+	baseImage string
+
+	// batchDirs, when not nil, causes the files to be written to a
+	// subdirectory of the output directory named after the chart, as in
+	// batch mode, unless outputDir is a template. It records which chart
+	// each directory was used for, so that no two charts in a batch are
+	// written to the same one.
+	batchDirs map[string]string
+
+	// batchTimer, when not nil, adds up how long each phase took across all
+	// of the charts in a batch.
+	batchTimer *phaseTimer
+}
+
+// overwrite reports whether existing files may be replaced. --force is
+// required, and when --require-overwrite-confirmation is also given, so is
+// the confirmation environment variable.
+func (o options) overwrite() bool {
+	if o.requireConfirm && os.Getenv(overwriteConfirmEnv) != "yes" {
+		return false
 	}
+	return o.force
+}
 
-	rootCmd.PersistentFlags().BoolVarP(&forceArg, "force", "f", false, "force overwrite of existing files")
+// defaultPlanDescription returns the description to give the default plan
+// of a chart with the given description: --plan-description, then the chart's
+// description if --plan-description-from-chart asks for it. It returns "" to
+// leave the generated one.
+func (o options) defaultPlanDescription(chartDescription string) string {
+	if len(o.planDescription) == 0 && o.planDescriptionFromChart {
+		return chartDescription
+	}
+	return o.planDescription
+}
 
-	err := rootCmd.Execute()
-	if err != nil {
-		fmt.Println(err.Error())
-		fmt.Println("could not execute command")
-		os.Exit(1)
+// readOpts collects the options that control how chart archives are read.
+func (o options) readOpts() readOptions {
+	return readOptions{
+		bestEffort:          o.bestEffort,
+		valuesName:          o.valuesName,
+		readme:              o.descriptionSource == descriptionSourceReadme,
+		schema:              o.expandParams,
+		maxDecompressedSize: o.maxDecompressedSize,
+		maxFileSize:         o.maxFileSize,
 	}
 }
 
-// fileExists returns true if either apb.yml or Dockerfile exist in the working
-// directory, else false
-func fileExists() (bool, error) {
-	for _, filename := range []string{apbYml, dockerfile} {
-		_, err := os.Stat(filename)
-		if err == nil {
-			// file exists
-			return true, nil
+// validate returns an error if o holds a flag value, or a combination of
+// flags, that no chart could be converted with.
+func (o options) validate() error {
+	if o.helmVersion != 0 && o.helmVersion != 2 && o.helmVersion != 3 {
+		return fmt.Errorf("invalid --helm-version %d: must be 2 or 3", o.helmVersion)
+	}
+	if len(strings.TrimSpace(o.baseImage)) == 0 {
+		return errors.New("invalid --base-image: must not be empty")
+	}
+	if len(o.chartOwner) > 0 && !chartOwnerPattern.MatchString(o.chartOwner) {
+		return fmt.Errorf("invalid --chart-owner %q: must be USER or USER:GROUP, by name or numeric ID", o.chartOwner)
+	}
+	if o.build && (o.dryRun || o.emitCR || o.emitChartJSON) {
+		return errors.New("--build cannot be combined with --dry-run, --emit-cr or --emit-chart-json")
+	}
+	if len(strings.TrimSpace(o.planName)) == 0 {
+		return errors.New("invalid --plan-name: must not be empty")
+	}
+	if o.async != "required" && o.async != "optional" && o.async != "unsupported" {
+		return fmt.Errorf("invalid --async %q: must be required, optional or unsupported", o.async)
+	}
+	if o.format != formatYAML && o.format != formatJSON {
+		return fmt.Errorf("invalid --format %q: must be %s or %s", o.format, formatYAML, formatJSON)
+	}
+	planLabels := map[string]bool{o.planName: true}
+	for _, arg := range o.plans {
+		label, _, err := parsePlanArg(arg)
+		if err != nil {
+			return err
 		}
-		if !os.IsNotExist(err) {
-			// error determining if file exists
-			return false, err
+		if label == o.planName {
+			return fmt.Errorf("invalid --plan label %q: the default plan already has that name", label)
 		}
+		if planLabels[label] {
+			return fmt.Errorf("invalid --plan label %q: each plan needs its own label", label)
+		}
+		planLabels[label] = true
 	}
-	// neither file exists
-	return false, nil
+	if len(o.name) > 0 {
+		bundleName := fmt.Sprintf("%s-apb", o.name)
+		if len(bundleName) > 63 || !dnsLabelPattern.MatchString(bundleName) {
+			return fmt.Errorf("invalid --name %q: %s must be a DNS label of at most 63 lowercase letters, digits and dashes", o.name, bundleName)
+		}
+	}
+	if o.descriptionSource != descriptionSourceChart && o.descriptionSource != descriptionSourceReadme {
+		return fmt.Errorf("invalid --description-source %q: must be %s or %s", o.descriptionSource, descriptionSourceChart, descriptionSourceReadme)
+	}
+	return nil
 }
 
-// writeApbYaml creates a new file named "apb.yml" in the current working
-// directory that can be used to build a service bundle.
-func writeApbYaml(v TarValues) error {
-	apb := NewAPB(v)
-	data, err := yaml.Marshal(apb)
-	if err != nil {
-		return err
+// chartReadOpts returns the readOptions that a chart is read with to convert
+// it: readOpts plus the files that prepareValues needs.
+func (o options) chartReadOpts() readOptions {
+	opts := o.readOpts()
+	if o.emitChartJSON {
+		// only Chart.yaml is printed, so nothing else needs to be read
+		opts.skipValues = true
+	} else {
+		opts.dependencies = true
+		opts.schema = true
+		for _, arg := range o.plans {
+			// already checked by validate
+			_, file, _ := parsePlanArg(arg)
+			opts.extraFiles = append(opts.extraFiles, file)
+		}
 	}
+	return opts
+}
 
-	f, err := os.Create(apbYml)
+// prepareValues fills in everything about the bundle generated from values
+// that depends on o, apart from where it is written: the chart's
+// dependencies, parameters and plans, the compatibility checks, and the
+// settings passed through to the templates. run, diff and validate all use
+// it, so that they agree on what a chart converts to.
+func prepareValues(values TarValues, o options) (TarValues, error) {
+	deps, err := chartDependencies(values)
 	if err != nil {
-		return err
+		logger.Warnf("could not read dependencies: %v", err)
+	}
+	if len(deps) > 0 {
+		names := make([]string, len(deps))
+		for i, dep := range deps {
+			names[i] = dep.Name
+		}
+		logger.Warnf("chart %s has dependencies that are only carried inside the chart archive: %s", values.Name, strings.Join(names, ", "))
+		values.Dependencies = deps
 	}
-	defer f.Close()
-
-	_, err = f.Write(data)
-	return err
-}
 
-// writeDockerfile creates a new file named "Dockerfile" in the current working
-// directory that can be used to build a service bundle.
-func writeDockerfile(v TarValues) error {
-	t, err := template.New(dockerfile).Parse(dockerfileTemplate)
-	if err != nil {
-		return err
+	if _, err := chartHelmVersion(values.Chart); err != nil && !containsString(o.allowAPIVersions, values.Chart.APIVersion) {
+		return values, fmt.Errorf("chart %s has apiVersion %q, which the base image may not package correctly; use --allow-apiversion %s to convert it anyway", values.Name, values.Chart.APIVersion, values.Chart.APIVersion)
 	}
 
-	f, err := os.Create(dockerfile)
-	if err != nil {
-		return err
+	if o.helmVersion != 0 {
+		err = checkHelmVersion(values.Chart, o.helmVersion)
+		if err != nil {
+			logger.Warnf("%s", err)
+		}
 	}
-	defer f.Close()
 
-	return t.Execute(f, v)
-}
+	// encoded is true when the values are embedded base64-encoded, and so
+	// cannot be read as YAML
+	encoded := isBinary(values.Values)
+	if encoded {
+		if o.force == false {
+			return values, fmt.Errorf("%s contains binary data; use --force to embed it base64-encoded", o.valuesName)
+		}
+		logger.Warnf("%s contains binary data, embedding it base64-encoded", o.valuesName)
+		values.Values = base64.StdEncoding.EncodeToString([]byte(values.Values))
+	}
 
-// getTarValues opens the helm chart tarball to 1) retrieve Chart.yaml so it can
-// be parsed, and 2) retrieve the entire contents of values.yaml.
-func getTarValues(filename string) (TarValues, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return TarValues{}, err
+	if o.descriptionSource == descriptionSourceReadme {
+		description := readmeDescription(values.Readme)
+		if len(description) > 0 {
+			values.Description = description
+		} else {
+			logger.Warnf("no description found in README.md, using the description from Chart.yaml")
+		}
 	}
-	defer file.Close()
 
-	uncompressed, err := gzip.NewReader(file)
-	if err != nil {
-		return TarValues{}, err
+	if encoded && (len(o.mergeValues) > 0 || o.normalizeValues) {
+		return values, fmt.Errorf("%s contains binary data, so --merge-values and --normalize-values cannot be used", o.valuesName)
 	}
 
-	tr := tar.NewReader(uncompressed)
-	var chart Chart
-	var values string
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			return TarValues{}, errors.New("Chart.yaml not found in archive")
+	if len(o.mergeValues) > 0 {
+		logger.Warnf("--merge-values discards comments from %s", o.valuesName)
+		values.Values, err = mergeValuesFiles(values.Values, o.mergeValues)
+		if err != nil {
+			return values, fmt.Errorf("could not merge values files: %v", err)
 		}
+	}
+
+	if o.normalizeValues {
+		logger.Warnf("--normalize-values discards comments from values.yaml")
+		values.Values, err = normalizeValues(values.Values)
 		if err != nil {
-			return TarValues{}, err
+			return values, fmt.Errorf("could not normalize values.yaml: %v", err)
 		}
+	}
 
-		chartMatch, err := path.Match("*/Chart.yaml", hdr.Name)
+	if encoded {
+		if o.expandParams || len(values.Schema) > 0 {
+			logger.Warnf("%s is embedded base64-encoded, so it is offered as a single values parameter", o.valuesName)
+		}
+	} else {
+		values.Parameters, err = valuesParameters(values.Values, values.Schema, o.expandParams)
 		if err != nil {
-			return TarValues{}, err
+			return values, fmt.Errorf("could not generate parameters from values: %v", err)
+		}
+	}
+
+	for _, arg := range o.plans {
+		label, file, _ := parsePlanArg(arg)
+		plan := PlanValues{Name: label, File: file}
+		plan.Values, err = planValuesFile(file, values)
+		if err == nil {
+			plan.Parameters, err = valuesParameters(plan.Values, values.Schema, o.expandParams)
 		}
-		valuesMatch, err := path.Match("*/values.yaml", hdr.Name)
 		if err != nil {
-			return TarValues{}, err
+			return values, fmt.Errorf("could not generate plan %s: %v", label, err)
 		}
-		if chartMatch {
-			chart, err = parseChart(tr)
-			if err != nil {
-				return TarValues{}, err
-			}
+		values.Plans = append(values.Plans, plan)
+	}
+
+	if o.emitChartJSON {
+		// only Chart.yaml is printed, so the rest is not needed
+		return values, nil
+	}
+
+	values.BaseImage = o.baseImage
+	values.ChartBuildArg = o.chartBuildArg
+	values.ChartDest = o.chartDest
+	values.Workdir = o.workdir
+	values.ChartOwner = o.chartOwner
+	values.OmitEmpty = o.omitEmpty
+	values.Bindable = o.bindable
+	values.BundleName = o.name
+	values.Async = o.async
+	values.PlanName = o.planName
+	values.Paid = !o.free
+	values.Format = o.format
+	if len(o.dockerfileTemplate) > 0 {
+		data, err := ioutil.ReadFile(o.dockerfileTemplate)
+		if err == nil {
+			_, err = template.New(dockerfile).Funcs(dockerfileFuncs).Parse(string(data))
 		}
-		if valuesMatch {
-			data, err := ioutil.ReadAll(tr)
-			if err != nil {
-				return TarValues{}, err
-			}
-			values = string(data)
+		if err != nil {
+			return values, fmt.Errorf("could not read Dockerfile template: %v", err)
 		}
-		if len(values) > 0 && len(chart.Name) > 0 {
-			break
+		values.DockerfileTemplate = string(data)
+	}
+	if o.embedIcon && len(values.Chart.Icon) > 0 && !strings.HasPrefix(values.Chart.Icon, "data:") {
+		values.ImageURL, err = fetchIcon(values.Chart.Icon)
+		if err != nil {
+			logger.Warnf("could not embed icon, using its URL: %v", err)
 		}
 	}
-	if len(values) > 0 && len(chart.Name) > 0 {
-		return TarValues{
-			Name:        chart.Name,
-			Description: chart.Description,
-			TarfileName: filename,
-			Values:      values,
-		}, nil
+	values.Tags = catalogTags(values.Chart, o.tagsAnnotation)
+	values.PlanDescription = o.defaultPlanDescription(values.Description)
+	if o.noOCILabels == false {
+		created, err := sourceDateEpoch()
+		if err != nil {
+			return values, err
+		}
+		values.Provenance = &Provenance{
+			Created: created,
+			Version: version,
+			Source:  o.sourceRef,
+		}
 	}
-	return TarValues{}, errors.New("Could not find both Chart.yaml and values.yaml")
+	return values, nil
+}
+
+func main() {
+	// o is filled in from the flags
+	var o options
+
+	// logFormatArg selects how diagnostic output is written, either "text" or
+	// "json".
+	var logFormatArg string
+
+	// verboseArg is true when the user specifies --verbose, and it indicates
+	// that each step of the conversion should be logged.
+	var verboseArg bool
+
+	// warningFormatArg selects how warnings are written, either "text" or
+	// "github" for GitHub Actions annotations.
+	var warningFormatArg string
+
+	// repoArg is the URL of a helm repository to fetch the chart named by
+	// chartArg from, instead of taking charts as arguments.
+	var repoArg string
+
+	// chartArg is the name of the chart to fetch from repoArg.
+	var chartArg string
+
+	// chartVersionArg is the version of the chart to fetch from repoArg, or
+	// empty for the latest.
+	var chartVersionArg string
+
+	var rootCmd = &cobra.Command{
+		Use:   "helm2bundle CHARTFILE|CHARTDIR...",
+		Short: "Packages a helm chart as a Service Bundle",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(repoArg) > 0 {
+				if len(args) > 0 {
+					return errors.New("--repo fetches the chart, so no CHARTFILE arguments can be given")
+				}
+				return nil
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			logger.verbose = verboseArg
+			err := logger.setFormat(logFormatArg)
+			if err == nil {
+				err = logger.setWarningFormat(warningFormatArg)
+			}
+			if err != nil {
+				logger.Errorf("%v", err)
+				os.Exit(1)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(repoArg) > 0 {
+				if len(chartArg) == 0 {
+					logger.Errorf("--repo needs --chart to name the chart to fetch")
+					os.Exit(1)
+				}
+				chartURL, err := resolveRepoChart(repoArg, chartArg, chartVersionArg)
+				if err != nil {
+					logger.Errorf("could not resolve chart: %v", err)
+					os.Exit(1)
+				}
+				logger.Debugf("resolved chart %s to %s", chartArg, chartURL)
+				args = []string{chartURL}
+			} else if len(chartArg) > 0 || len(chartVersionArg) > 0 {
+				logger.Errorf("--chart and --version can only be used with --repo")
+				os.Exit(1)
+			}
+
+			if len(args) == 1 {
+				err := run(args[0], o)
+				if err != nil {
+					logger.Errorf("%v", err)
+					os.Exit(1)
+				}
+				return
+			}
+
+			if len(o.name) > 0 || len(o.tag) > 0 {
+				logger.Errorf("--name and --tag can only be used with a single chart")
+				os.Exit(1)
+			}
+			// convert every chart, even after one fails
+			batch := o
+			batch.batchDirs = make(map[string]string)
+			if o.timings {
+				batch.batchTimer = newPhaseTimer(fmt.Sprintf("%d charts", len(args)))
+			}
+			failed := 0
+			for _, filename := range args {
+				err := run(filename, batch)
+				if err != nil {
+					logger.Errorf("%s: %v", filename, err)
+					failed++
+				}
+			}
+			if batch.batchTimer != nil {
+				batch.batchTimer.report()
+			}
+			if failed > 0 {
+				logger.Errorf("%d of %d charts could not be converted", failed, len(args))
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.PersistentFlags().BoolVarP(&o.force, "force", "f", false, "force overwrite of existing files")
+	rootCmd.PersistentFlags().BoolVar(&o.dryRun, "dry-run", false, "print the generated files to stdout instead of writing them")
+	rootCmd.PersistentFlags().StringVarP(&o.outputDir, "output-dir", "o", ".", "directory to write generated files into, created if needed; may be a template using Chart.yaml fields, e.g. bundles/{{.Name}}-{{.Version}}")
+	rootCmd.PersistentFlags().BoolVar(&o.requireConfirm, "require-overwrite-confirmation", false, "only let --force overwrite files when "+overwriteConfirmEnv+"=yes is set")
+	rootCmd.PersistentFlags().StringVar(&logFormatArg, "log-format", logFormatText, "format of diagnostic output: text or json")
+	rootCmd.PersistentFlags().BoolVarP(&verboseArg, "verbose", "v", false, "log each step of the conversion")
+	rootCmd.PersistentFlags().StringVar(&warningFormatArg, "warning-format", warningFormatText, "format of warnings: text or github")
+	rootCmd.PersistentFlags().BoolVar(&o.bestEffort, "best-effort", false, "convert even if values.yaml or the chart name is missing")
+	rootCmd.PersistentFlags().StringVar(&o.valuesName, "values-name", defaultValuesName, "name of the file at the chart root that supplies default values")
+	rootCmd.PersistentFlags().Int64Var(&o.maxFileSize, "max-file-size", defaultMaxFileSize, "most bytes each file read from a chart may contain, or 0 for no limit")
+	rootCmd.PersistentFlags().Int64Var(&o.maxDecompressedSize, "max-decompressed-size", defaultMaxDecompressedSize, "most bytes a chart archive may decompress to, or 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&o.baseImage, "base-image", defaultBaseImage, "image that the generated Dockerfile builds FROM")
+	rootCmd.PersistentFlags().BoolVar(&o.contextCompress, "context-chart-compress", true, "gzip the chart placed in the build context; false leaves it an uncompressed tar")
+	rootCmd.PersistentFlags().StringVar(&o.chartDest, "chart-dest", defaultChartDest, "path in the image that the chart is copied to")
+	rootCmd.PersistentFlags().StringVar(&o.workdir, "workdir", "", "WORKDIR to set in the Dockerfile")
+	rootCmd.PersistentFlags().StringVar(&o.chartOwner, "chart-owner", "", "USER[:GROUP] to own the chart in the image, via COPY --chown")
+	rootCmd.PersistentFlags().BoolVar(&o.chartBuildArg, "chart-build-arg", false, "COPY the chart from the CHART_TGZ build arg instead of a fixed filename")
+	rootCmd.PersistentFlags().StringArrayVar(&o.plans, "plan", nil, "LABEL=FILE adding a plan whose default values are FILE, from disk or the chart root; repeat for more plans")
+	rootCmd.PersistentFlags().StringArrayVar(&o.mergeValues, "merge-values", nil, "values file to deep-merge over the chart's values; repeat to layer several, later files win")
+	rootCmd.PersistentFlags().BoolVar(&o.expandParams, "expand-params", false, "generate one parameter per top-level values key instead of a single textarea")
+	rootCmd.PersistentFlags().BoolVar(&o.normalizeValues, "normalize-values", false, "re-indent values.yaml consistently before embedding it (drops comments)")
+	rootCmd.PersistentFlags().BoolVar(&o.noOCILabels, "no-oci-labels", false, "leave OCI provenance labels out of the Dockerfile")
+	rootCmd.PersistentFlags().StringVar(&o.sourceRef, "source-ref", "", "source reference recorded in the org.opencontainers.image.source label; the created label is only added when "+sourceDateEpochEnv+" is set")
+	rootCmd.PersistentFlags().StringVar(&o.planDescription, "plan-description", "", "description of the default plan")
+	rootCmd.PersistentFlags().BoolVar(&o.planDescriptionFromChart, "plan-description-from-chart", false, "use the chart's description for the default plan unless --plan-description is given")
+	rootCmd.PersistentFlags().StringVar(&o.tagsAnnotation, "tags-from-annotation", "", "chart annotation with comma-separated tags to add to the catalog tags, which always include the chart's keywords")
+	rootCmd.PersistentFlags().StringVar(&o.descriptionSource, "description-source", descriptionSourceChart, "where the bundle description comes from: chart or readme")
+	rootCmd.PersistentFlags().BoolVar(&o.nameFiles, "name-files", false, "prefix output filenames with the bundle name, e.g. NAME-apb.apb.yml")
+	rootCmd.PersistentFlags().BoolVar(&o.timings, "timings", false, "log how long each phase of the conversion took")
+	rootCmd.PersistentFlags().BoolVar(&o.withBuildScript, "with-build-script", false, "also write an executable build.sh that builds and tags the image")
+	rootCmd.PersistentFlags().BoolVar(&o.build, "build", false, "build the image after generating the Dockerfile")
+	rootCmd.PersistentFlags().StringVar(&o.tag, "tag", "", "tag for the image built by --build, instead of the bundle name")
+	rootCmd.PersistentFlags().StringVar(&o.runtime, "runtime", "", "container runtime for --build, instead of the first of docker or podman found")
+	rootCmd.PersistentFlags().StringVar(&o.name, "name", "", "base name of the bundle, used instead of the chart name in its name and display name")
+	rootCmd.PersistentFlags().BoolVar(&o.embedIcon, "embed-icon", false, "download the chart's icon and embed it in the spec as a data URI")
+	rootCmd.PersistentFlags().StringArrayVar(&o.allowAPIVersions, "allow-apiversion", nil, "chart apiVersion to convert even though it is not recognized; repeat for more")
+	rootCmd.PersistentFlags().StringVar(&o.dockerfileTemplate, "dockerfile-template", "", "file with a text/template to render the Dockerfile with instead of the built-in one; "+
+		"it can use .Name, .Description, .TarfileName, .BaseImage, .EncodedSpec (the base64 spec for the com.redhat.apb.spec label), .ChartDest, .ChartBuildArg, .Workdir, .ChartOwner, .Provenance and .Chart (the parsed Chart.yaml), and labelValue to escape text for a quoted LABEL")
+	rootCmd.PersistentFlags().BoolVar(&o.merge, "merge", false, "update the fields derived from the chart, such as the description, chart metadata and parameters, in an existing spec file, keeping other edits, and regenerate the Dockerfile")
+	rootCmd.PersistentFlags().BoolVar(&o.verify, "verify", false, "refuse to convert the chart unless CHARTFILE.prov is a valid signature of it")
+	rootCmd.PersistentFlags().StringVar(&o.keyring, "keyring", defaultKeyring(), "public keyring used by --verify")
+	rootCmd.Flags().StringVar(&repoArg, "repo", "", "URL of a helm repository to fetch the chart from, instead of taking a CHARTFILE argument")
+	rootCmd.Flags().StringVar(&chartArg, "chart", "", "name of the chart to fetch from --repo")
+	rootCmd.Flags().StringVar(&chartVersionArg, "version", "", "version of the chart to fetch from --repo; the latest release by default")
+	rootCmd.PersistentFlags().StringVar(&o.format, "format", formatYAML, "format of the generated spec file: yaml for apb.yml or json for apb.json")
+	rootCmd.PersistentFlags().StringVar(&o.planName, "plan-name", "default", "name of the default plan")
+	rootCmd.PersistentFlags().BoolVar(&o.free, "free", true, "whether the default plan is free; --free=false marks it paid")
+	rootCmd.PersistentFlags().StringVar(&o.async, "async", "optional", "whether the bundle runs asynchronously: required, optional or unsupported")
+	rootCmd.PersistentFlags().BoolVar(&o.bindable, "bindable", false, "mark the generated bundle as bindable")
+	rootCmd.PersistentFlags().BoolVar(&o.omitEmpty, "omit-empty", false, "leave null and empty fields out of the generated spec")
+	rootCmd.PersistentFlags().BoolVar(&o.mappingReport, "mapping-report", false, "print a table showing where chart data landed in the bundle")
+	rootCmd.PersistentFlags().IntVar(&o.helmVersion, "helm-version", 0, "major version of helm (2 or 3) in the base image, to check chart compatibility")
+	rootCmd.PersistentFlags().BoolVar(&o.emitChartJSON, "emit-chart-json", false, "print the parsed Chart.yaml as JSON instead of generating a bundle")
+	rootCmd.PersistentFlags().BoolVar(&o.emitCR, "emit-cr", false, "print a Kubernetes custom resource for the bundle instead of generating a bundle")
+
+	var diffCmd = &cobra.Command{
+		Use:   "diff CHART_OLD CHART_NEW",
+		Short: "Shows how the apb.yml generated for two charts differs",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			diff, err := diffCharts(args[0], args[1], o)
+			if err != nil {
+				logger.Errorf("could not diff helm charts: %v", err)
+				os.Exit(1)
+			}
+			fmt.Print(diff)
+		},
+	}
+	rootCmd.AddCommand(diffCmd)
+
+	var validateCmd = &cobra.Command{
+		Use:   "validate CHARTFILE",
+		Short: "Checks that helm2bundle can convert a chart, without writing any files",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := validateChart(os.Stdout, args[0], o)
+			if err != nil {
+				logger.Errorf("chart is not valid: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	rootCmd.AddCommand(validateCmd)
+
+	// extractToArg is the directory that the extract subcommand writes the
+	// chart's files into.
+	var extractToArg string
+
+	var extractCmd = &cobra.Command{
+		Use:   "extract CHARTFILE",
+		Short: "Writes the Chart.yaml and values file that helm2bundle finds in a chart",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			values, err := getChartValues(args[0], o.readOpts())
+			if err != nil {
+				logger.Errorf("could not get values from helm chart: %v", err)
+				os.Exit(1)
+			}
+			err = extractChartFiles(values, extractToArg, o.valuesName, o.overwrite())
+			if err != nil {
+				logger.Errorf("could not extract chart files: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	extractCmd.Flags().StringVar(&extractToArg, "extract-to", ".", "directory to write Chart.yaml and the values file into")
+	rootCmd.AddCommand(extractCmd)
+
+	err := rootCmd.Execute()
+	if err != nil {
+		logger.Errorf("could not execute command: %v", err)
+		os.Exit(1)
+	}
+}
+
+// run converts the chart at filename, which may be a path or a URL, into a
+// bundle according to o. When o.batchDirs is not nil, the files are written
+// to a subdirectory of the output directory named after the chart, unless the
+// output directory is a template.
+func run(filename string, o options) error {
+	err := o.validate()
+	if err != nil {
+		return err
+	}
+
+	timer := newPhaseTimer(filename)
+	if o.timings {
+		// report however the conversion ends, including the early returns
+		// that print to stdout
+		defer timer.report()
+	}
+	if o.batchTimer != nil {
+		defer o.batchTimer.add(timer)
+	}
+	logger.file = filename
+
+	// fetched is true when the chart was downloaded to a temporary file
+	fetched := isURL(filename)
+	if fetched {
+		tmpDir, chartFile, err := fetchChart(filename)
+		if err != nil {
+			return fmt.Errorf("could not fetch helm chart: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		if o.verify {
+			err = downloadFile(filename+provenanceSuffix, chartFile+provenanceSuffix)
+			if err != nil {
+				return fmt.Errorf("could not fetch provenance file: %v", err)
+			}
+		}
+		filename = chartFile
+		timer.mark("fetch")
+	}
+
+	if o.verify {
+		if isDir(filename) {
+			return errors.New("--verify needs a packaged chart, not a directory")
+		}
+		signer, err := verifyProvenance(filename, filename+provenanceSuffix, o.keyring)
+		if err != nil {
+			return fmt.Errorf("could not verify chart: %v", err)
+		}
+		logger.Infof("verified %s, signed by %s", filepath.Base(filename), signer)
+		timer.mark("verify")
+	}
+
+	opts := o.chartReadOpts()
+	values, err := getChartValues(filename, opts)
+	if err != nil {
+		return fmt.Errorf("could not get values from helm chart: %v", err)
+	}
+	timer.mark("parse")
+	logger.Debugf("chart name %q, description %q, icon %q", values.Name, values.Description, values.Chart.Icon)
+	if !opts.skipValues {
+		logger.Debugf("%s is %d bytes", o.valuesName, len(values.Values))
+	}
+
+	values, err = prepareValues(values, o)
+	if err != nil {
+		return err
+	}
+	timer.mark("prepare")
+
+	if o.emitChartJSON {
+		err = writeChartJSON(os.Stdout, values.Chart)
+		if err != nil {
+			return fmt.Errorf("could not render chart as JSON: %v", err)
+		}
+		return nil
+	}
+
+	if o.emitCR {
+		err = writeBundleCR(os.Stdout, values)
+		if err != nil {
+			return fmt.Errorf("could not render custom resource: %v", err)
+		}
+		// no Dockerfile copies the chart, so leave that out of the report
+		reported := values
+		reported.TarfileName = ""
+		return reportMappings(o, reported)
+	}
+
+	outputDir, err := expandOutputDir(o.outputDir, values.Chart)
+	if err != nil {
+		return fmt.Errorf("could not determine output directory: %v", err)
+	}
+	if o.batchDirs != nil {
+		// a template already names each chart's directory
+		if !strings.Contains(o.outputDir, "{{") {
+			subdir := batchSubdir(values)
+			if len(subdir) == 0 {
+				return fmt.Errorf("could not name an output subdirectory for %s", filename)
+			}
+			outputDir = filepath.Join(outputDir, subdir)
+		}
+		if other, ok := o.batchDirs[outputDir]; ok {
+			return fmt.Errorf("%s would be written to %s, which %s was already written to; use an --output-dir template that tells them apart", filename, outputDir, other)
+		}
+		o.batchDirs[outputDir] = filename
+	}
+
+	apbFile, dockerFile, scriptFile := outputNames(values, o.nameFiles)
+	if o.merge {
+		existing, err := readApbFile(filepath.Join(outputDir, apbFile))
+		if err != nil {
+			return fmt.Errorf("could not read existing %s: %v", apbFile, err)
+		}
+		if existing != nil {
+			values.Spec = mergeAPB(existing, NewAPB(values))
+		}
+	}
+	if !o.dryRun {
+		err = checkOutputFiles(outputDir, apbFile, dockerFile, scriptFile, o)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(outputDir, 0755)
+		if err != nil {
+			return fmt.Errorf("could not create output directory: %v", err)
+		}
+	}
+	values.TarfileName, err = contextChart(filename, values, outputDir, o.contextCompress, o.overwrite() || (o.merge && !o.dryRun), o.dryRun, fetched)
+	if err != nil {
+		return fmt.Errorf("could not copy chart into output directory: %v", err)
+	}
+	logger.Debugf("chart is %s in the build context %s", values.TarfileName, outputDir)
+	timer.mark("context")
+
+	values.DockerfileName = dockerFile
+	values.ImageTag = o.tag
+	if len(values.ImageTag) == 0 {
+		values.ImageTag = NewAPB(values).Name
+	}
+	files, err := renderBundle(values, apbFile, dockerFile, scriptFile, o.withBuildScript)
+	if err != nil {
+		return err
+	}
+	timer.mark("render")
+
+	if o.dryRun {
+		err = writeDryRun(os.Stdout, files)
+		if err != nil {
+			return err
+		}
+		return reportMappings(o, values)
+	}
+	err = writeBundle(outputDir, files)
+	if err != nil {
+		return err
+	}
+	timer.mark("write")
+
+	if o.build {
+		err = buildImage(o.runtime, values.ImageTag, filepath.Join(outputDir, dockerFile), outputDir, values)
+		if err != nil {
+			return fmt.Errorf("could not build image: %v", err)
+		}
+		timer.mark("build")
+	}
+
+	return reportMappings(o, values)
+}
+
+// outputNames returns the names of the apb.yml, Dockerfile and build script to
+// write for a chart. When nameFiles is true, each is prefixed with the
+// bundle's name so that several bundles can share a directory.
+func outputNames(v TarValues, nameFiles bool) (string, string, string) {
+	spec := apbYml
+	if v.Format == formatJSON {
+		spec = apbJSON
+	}
+	if !nameFiles {
+		return spec, dockerfile, buildScript
+	}
+	name := NewAPB(v).Name
+	return fmt.Sprintf("%s.%s", name, spec), fmt.Sprintf("%s.%s", name, dockerfile), fmt.Sprintf("%s.%s", name, buildScript)
+}
+
+// checkOutputFiles returns an error if writing the named files into dir would
+// replace existing files that o does not allow to be overwritten.
+func checkOutputFiles(dir, apbFile, dockerFile, scriptFile string, o options) error {
+	apbFile = filepath.Join(dir, apbFile)
+	dockerFile = filepath.Join(dir, dockerFile)
+	scriptFile = filepath.Join(dir, scriptFile)
+	if o.overwrite() == false && o.merge == false {
+		// fail if one of the files already exists
+		exists, err := fileExists(apbFile, dockerFile)
+		if err != nil {
+			return fmt.Errorf("could not check for existing files: %v", err)
+		}
+		if exists && o.force {
+			return fmt.Errorf("set %s=yes to let --force overwrite existing %s and/or %s", overwriteConfirmEnv, dockerFile, apbFile)
+		}
+		if exists {
+			return fmt.Errorf("use --force to overwrite existing %s and/or %s", dockerFile, apbFile)
+		}
+	}
+	if o.overwrite() == false && o.withBuildScript {
+		// --merge only ever updates the spec file, so it never allows this
+		exists, err := fileExists(scriptFile)
+		if err != nil {
+			return fmt.Errorf("could not check for existing files: %v", err)
+		}
+		if exists {
+			return fmt.Errorf("use --force to overwrite existing %s", scriptFile)
+		}
+	}
+	return nil
+}
+
+// batchSubdir returns the subdirectory of the output directory that a chart's
+// files are written to in batch mode: NAME-VERSION, like the packaged chart,
+// falling back to a name taken from the chart's filename. It returns "" if
+// there is no usable name.
+func batchSubdir(v TarValues) string {
+	name := v.Name
+	if len(name) == 0 {
+		name = placeholderName(v.TarfileName)
+	}
+	if len(v.Chart.Version) > 0 {
+		name = fmt.Sprintf("%s-%s", name, v.Chart.Version)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return ""
+	}
+	return name
+}
+
+// phaseTimer records how long each phase of a conversion took.
+type phaseTimer struct {
+	// name is what is being timed, such as the chart, named in each line of
+	// the report.
+	name   string
+	start  time.Time
+	last   time.Time
+	phases []phaseTiming
+}
+
+// phaseTiming is the duration of one named phase.
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// newPhaseTimer returns a phaseTimer for name whose first phase starts now.
+func newPhaseTimer(name string) *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{name: name, start: now, last: now}
+}
+
+// mark ends the current phase, recording it under name, and starts the next.
+func (t *phaseTimer) mark(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, phaseTiming{name, now.Sub(t.last)})
+	t.last = now
+}
+
+// add adds the duration of each of other's phases to the phase of the same
+// name, and extends the total to now.
+func (t *phaseTimer) add(other *phaseTimer) {
+	for _, phase := range other.phases {
+		i := 0
+		for i < len(t.phases) && t.phases[i].name != phase.name {
+			i++
+		}
+		if i == len(t.phases) {
+			t.phases = append(t.phases, phaseTiming{name: phase.name})
+		}
+		t.phases[i].duration += phase.duration
+	}
+	t.last = time.Now()
+}
+
+// report logs the duration of each phase followed by the total.
+func (t *phaseTimer) report() {
+	for _, phase := range t.phases {
+		logger.Infof("timing: %s: %s took %s", t.name, phase.name, phase.duration)
+	}
+	logger.Infof("timing: %s: total %s", t.name, t.last.Sub(t.start))
+}
+
+// expandOutputDir evaluates the --output-dir value as a template with the
+// chart's data, so that each chart can get its own directory.
+func expandOutputDir(pattern string, c Chart) (string, error) {
+	t, err := template.New("output-dir").Parse(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid --output-dir template: %v", err)
+	}
+	var dir bytes.Buffer
+	err = t.Execute(&dir, c)
+	if err != nil {
+		return "", fmt.Errorf("invalid --output-dir template: %v", err)
+	}
+	if dir.Len() == 0 {
+		return "", fmt.Errorf("--output-dir template %q expands to an empty path", pattern)
+	}
+	return dir.String(), nil
+}
+
+// chartContextPath returns the path, relative to the build context dir, that
+// the Dockerfile should COPY the chart from. The returned bool is true when the
+// chart is outside of dir and must first be copied into it under its base
+// name.
+func chartContextPath(filename, dir string) (string, bool, error) {
+	absChart, err := filepath.Abs(filename)
+	if err != nil {
+		return "", false, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false, err
+	}
+	rel, err := filepath.Rel(absDir, absChart)
+	if err != nil {
+		return "", false, err
+	}
+	if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(rel), false, nil
+	}
+	return filepath.Base(filename), true, nil
+}
+
+// contextChart returns the path, relative to the build context dir, that the
+// Dockerfile should COPY the chart from, and makes sure the chart is there. A
+// chart archive that is already inside dir and compressed as requested is used
+// in place. Otherwise the archive is copied into dir, converting its
+// compression if needed, or a chart directory is packaged into dir. A
+// temporary chart, such as a downloaded one, is always copied. Existing files
+// are only replaced if overwrite is true, and nothing is written when dryRun is
+// true. The chart is written to a temporary file that is then renamed into
+// place, so that even a chart that replaces itself is read in full first.
+func contextChart(filename string, v TarValues, dir string, compress, overwrite, dryRun, temporary bool) (string, error) {
+	var name string
+	var write func(f *os.File) error
+	if isDir(filename) {
+		name = packagedName(v, compress)
+		write = func(f *os.File) error {
+			return packageChart(f, filename, v.Name, compress, filepath.Join(dir, name), f.Name())
+		}
+	} else {
+		gzipped, err := isGzipped(filename)
+		if err != nil {
+			return "", err
+		}
+		if gzipped == compress {
+			needsCopy := true
+			name = filepath.Base(filename)
+			if !temporary {
+				name, needsCopy, err = chartContextPath(filename, dir)
+			}
+			if err != nil || !needsCopy {
+				return name, err
+			}
+			write = func(f *os.File) error {
+				return copyChart(f, filename, false, false)
+			}
+		} else {
+			name = recompressedName(filename, compress)
+			write = func(f *os.File) error {
+				return copyChart(f, filename, gzipped, compress)
+			}
+		}
+	}
+	if dryRun {
+		return name, nil
+	}
+
+	target := filepath.Join(dir, name)
+	if !overwrite {
+		exists, err := fileExists(target)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("use --force to overwrite existing %s", target)
+		}
+	}
+	same, err := samePath(filename, target)
+	if err != nil {
+		return "", err
+	}
+	if same {
+		logger.Warnf("replacing %s with a recompressed copy of itself", target)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	// only left behind if something failed
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), target)
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// samePath returns true if a and b, once cleaned and made absolute, are the
+// same path.
+func samePath(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return absA == absB, nil
+}
+
+// isGzipped returns true if the file starts with the gzip magic bytes.
+func isGzipped(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(gzipMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	return string(magic) == gzipMagic, err
+}
+
+// recompressedName returns the name that a chart archive is given when it is
+// copied with its compression changed.
+func recompressedName(filename string, compress bool) string {
+	name := filepath.Base(filename)
+	name = strings.TrimSuffix(name, chartExtension(name))
+	if compress {
+		return name + ".tgz"
+	}
+	return name + ".tar"
+}
+
+// copyChart copies the chart archive at filename to w. If gzipped is true the
+// archive is decompressed as it is read, and if compress is true it is
+// compressed as it is written.
+func copyChart(w io.Writer, filename string, gzipped, compress bool) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var src io.Reader = in
+	if gzipped {
+		gr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		src = gr
+	}
+	if !compress {
+		_, err = io.Copy(w, src)
+		return err
+	}
+	gw := gzip.NewWriter(w)
+	_, err = io.Copy(gw, src)
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// packageChart writes a tarball of the chart directory dir to w, gzipped if
+// compress is true. Every file is placed under a top-level directory with the
+// chart's name, which is the layout "helm package" produces. The files in
+// skip, such as where the tarball is being written, are left out.
+func packageChart(w io.Writer, dir, name string, compress bool, skip ...string) error {
+	var err error
+	absSkip := make([]string, len(skip))
+	for i, p := range skip {
+		absSkip[i], err = filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	var gw *gzip.Writer
+	if compress {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, err := filepath.Abs(p); err != nil || containsString(absSkip, abs) {
+			// never package the tarball into itself
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil || gw == nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// containerRuntimes are the runtimes that --build looks for, in order.
+var containerRuntimes = []string{"docker", "podman"}
+
+// buildImage builds the bundle image from dockerFile with dir as the build
+// context, streaming the runtime's output. The first of containerRuntimes
+// that is installed is used unless runtime names one.
+func buildImage(runtime, tag, dockerFile, dir string, v TarValues) error {
+	if len(runtime) == 0 {
+		for _, candidate := range containerRuntimes {
+			if _, err := exec.LookPath(candidate); err == nil {
+				runtime = candidate
+				break
+			}
+		}
+		if len(runtime) == 0 {
+			return fmt.Errorf("none of %s found; use --runtime to choose one", strings.Join(containerRuntimes, ", "))
+		}
+	}
+
+	args := []string{"build", "-t", tag, "-f", dockerFile}
+	if v.ChartBuildArg {
+		args = append(args, "--build-arg", "CHART_TGZ="+v.TarfileName)
+	}
+	args = append(args, dir)
+	logger.Infof("%s %s", runtime, strings.Join(args, " "))
+	cmd := exec.Command(runtime, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// fileExists returns true if any of the named files exist, else false
+func fileExists(filenames ...string) (bool, error) {
+	for _, filename := range filenames {
+		_, err := os.Stat(filename)
+		if err == nil {
+			// file exists
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			// error determining if file exists
+			return false, err
+		}
+	}
+	// neither file exists
+	return false, nil
+}
+
+// renderApbYaml returns the contents of the apb.yml file for a chart.
+func renderApbYaml(v TarValues) ([]byte, error) {
+	return marshalYaml(bundleSpec(v), v.OmitEmpty)
+}
+
+// bundleSpec returns the APB to write for v: the merged spec when one was
+// prepared by --merge, and otherwise the one generated from the chart.
+func bundleSpec(v TarValues) *APB {
+	if v.Spec != nil {
+		return v.Spec
+	}
+	return NewAPB(v)
+}
+
+// readApbFile reads the existing spec file at filename, in YAML or, if its
+// name ends in .json, JSON. It returns nil if the file does not exist.
+func readApbFile(filename string) (*APB, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var apb APB
+	if strings.HasSuffix(filename, ".json") {
+		err = json.Unmarshal(data, &apb)
+	} else {
+		err = yaml.Unmarshal(data, &apb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &apb, nil
+}
+
+// chartMetadataKeys are the metadata keys that NewAPB derives from the chart,
+// which mergeAPB refreshes.
+var chartMetadataKeys = []string{"imageUrl", "chartApiVersion", "chartVersion", "appVersion", "kubeVersion", "maintainers", "dependencies", "tags"}
+
+// mergeAPB updates the fields of the existing spec that are derived from the
+// chart with their values from generated: the description, the metadata keys
+// in chartMetadataKeys, and the parameters of each plan that the chart
+// generates, whose defaults are refreshed and which are added if missing.
+// Everything else, such as added plans and metadata or the bindable flag, is
+// kept. When the chart version is unchanged, a replaced value can only have
+// been edited by hand, so that conflict is logged as a warning.
+func mergeAPB(existing, generated *APB) *APB {
+	chartUpdated := !sameValue(existing.Metadata["chartVersion"], generated.Metadata["chartVersion"])
+	replacing := func(field string) {
+		if chartUpdated {
+			logger.Debugf("updating %s from the new chart version", field)
+		} else {
+			logger.Warnf("replacing %s, which was changed by hand, with the chart's", field)
+		}
+	}
+
+	merged := *existing
+	if merged.Description != generated.Description {
+		replacing("description")
+		merged.Description = generated.Description
+	}
+
+	metadata := make(map[string]interface{}, len(existing.Metadata))
+	for key, value := range existing.Metadata {
+		metadata[key] = value
+	}
+	for _, key := range chartMetadataKeys {
+		value, ok := generated.Metadata[key]
+		old, had := metadata[key]
+		switch {
+		case ok && (!had || !sameValue(old, value)):
+			if had {
+				replacing("metadata." + key)
+			}
+			metadata[key] = value
+		case !ok && had:
+			replacing("metadata." + key)
+			delete(metadata, key)
+		}
+	}
+	merged.Metadata = metadata
+
+	merged.Plans = append([]Plan(nil), existing.Plans...)
+	for _, plan := range generated.Plans {
+		i := planIndex(merged.Plans, plan.Name)
+		if i < 0 {
+			merged.Plans = append(merged.Plans, plan)
+			continue
+		}
+		parameters := append([]Parameter(nil), merged.Plans[i].Parameters...)
+		for _, p := range plan.Parameters {
+			j := parameterIndex(parameters, p.Name)
+			if j < 0 {
+				logger.Infof("adding parameter %s to plan %s", p.Name, plan.Name)
+				parameters = append(parameters, p)
+				continue
+			}
+			if !sameValue(parameters[j].Default, p.Default) {
+				replacing(fmt.Sprintf("the default of parameter %s in plan %s", p.Name, plan.Name))
+				parameters[j].Default = p.Default
+			}
+		}
+		merged.Plans[i].Parameters = parameters
+	}
+	return &merged
+}
+
+// sameValue returns true if a and b have the same YAML representation, so that
+// a value read from an existing spec compares equal to the one it was
+// generated from.
+func sameValue(a, b interface{}) bool {
+	aData, aErr := canonicalYaml(a)
+	bData, bErr := canonicalYaml(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aData, bData)
+}
+
+// canonicalYaml marshals in to YAML as a generic value, which sorts the keys
+// of structs and maps alike.
+func canonicalYaml(in interface{}) ([]byte, error) {
+	data, err := yaml.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	err = yaml.Unmarshal(data, &generic)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+// parameterIndex returns the index of the parameter called name, or -1.
+func parameterIndex(parameters []Parameter, name string) int {
+	for i, p := range parameters {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// planIndex returns the index of the plan called name, or -1.
+func planIndex(plans []Plan, name string) int {
+	for i, plan := range plans {
+		if plan.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// renderApbJSON returns the APB generated from v as an indented JSON document.
+func renderApbJSON(v TarValues) ([]byte, error) {
+	var in interface{} = bundleSpec(v)
+	if v.OmitEmpty {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		// decode into a fresh value, since decoding into in would only
+		// fill in the APB it points to again
+		var doc interface{}
+		err = json.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, err
+		}
+		in = pruneEmpty(doc)
+	}
+	data, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// marshalYaml marshals in to YAML. When omitEmpty is true, fields whose value
+// is null, an empty string, or an empty map or list are left out. Booleans
+// and numbers are always kept, since false and 0 are meaningful.
+func marshalYaml(in interface{}, omitEmpty bool) ([]byte, error) {
+	data, err := yaml.Marshal(in)
+	if err != nil || !omitEmpty {
+		return data, err
+	}
+
+	var doc yaml.MapSlice
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(pruneEmpty(doc))
+}
+
+// pruneEmpty recursively removes empty values from maps and lists parsed by
+// yaml.Unmarshal into a yaml.MapSlice.
+func pruneEmpty(in interface{}) interface{} {
+	switch value := in.(type) {
+	case yaml.MapSlice:
+		pruned := yaml.MapSlice{}
+		for _, item := range value {
+			item.Value = pruneEmpty(item.Value)
+			if !isEmpty(item.Value) {
+				pruned = append(pruned, item)
+			}
+		}
+		return pruned
+	case map[string]interface{}:
+		pruned := map[string]interface{}{}
+		for key, item := range value {
+			item = pruneEmpty(item)
+			if !isEmpty(item) {
+				pruned[key] = item
+			}
+		}
+		return pruned
+	case []interface{}:
+		pruned := []interface{}{}
+		for _, item := range value {
+			item = pruneEmpty(item)
+			if !isEmpty(item) {
+				pruned = append(pruned, item)
+			}
+		}
+		return pruned
+	}
+	return in
+}
+
+// isEmpty returns true for the values that pruneEmpty removes.
+func isEmpty(in interface{}) bool {
+	switch value := in.(type) {
+	case nil:
+		return true
+	case string:
+		return len(value) == 0
+	case yaml.MapSlice:
+		return len(value) == 0
+	case map[string]interface{}:
+		return len(value) == 0
+	case []interface{}:
+		return len(value) == 0
+	}
+	return false
+}
+
+// bundleFile is one generated file and the name it is written under.
+type bundleFile struct {
+	name    string
+	content []byte
+	mode    os.FileMode
+}
+
+// renderBundle renders the apb.yml and Dockerfile for v and, when withScript
+// is true, the build script, without writing anything.
+func renderBundle(v TarValues, apbFile, dockerFile, scriptFile string, withScript bool) ([]bundleFile, error) {
+	renders := []struct {
+		name   string
+		mode   os.FileMode
+		render func(io.Writer, TarValues) error
+	}{
+		{apbFile, 0644, writeApbYaml},
+		{dockerFile, 0644, writeDockerfile},
+	}
+	if withScript {
+		renders = append(renders, struct {
+			name   string
+			mode   os.FileMode
+			render func(io.Writer, TarValues) error
+		}{scriptFile, 0755, writeBuildScript})
+	}
+
+	files := make([]bundleFile, 0, len(renders))
+	for _, r := range renders {
+		var buf bytes.Buffer
+		err := r.render(&buf, v)
+		if err != nil {
+			return nil, fmt.Errorf("could not render %s: %v", r.name, err)
+		}
+		files = append(files, bundleFile{name: r.name, content: buf.Bytes(), mode: r.mode})
+	}
+	return files, nil
+}
+
+// writeBundle writes each of files into dir.
+func writeBundle(dir string, files []bundleFile) error {
+	for _, f := range files {
+		filename := filepath.Join(dir, f.name)
+		err := ioutil.WriteFile(filename, f.content, f.mode)
+		if err == nil {
+			// WriteFile only applies the mode to new files
+			err = os.Chmod(filename, f.mode)
+		}
+		if err != nil {
+			return fmt.Errorf("could not write %s: %v", filename, err)
+		}
+		logger.Debugf("wrote %s", filename)
+	}
+	return nil
+}
+
+// writeDryRun writes the files that would be generated to w, each preceded
+// by a delimiter line with its name.
+func writeDryRun(w io.Writer, files []bundleFile) error {
+	for _, f := range files {
+		fmt.Fprintf(w, "--- %s ---\n", f.name)
+		_, err := w.Write(f.content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeApbYaml writes an apb.yml document to w that can be used to build a
+// service bundle.
+func writeApbYaml(w io.Writer, v TarValues) error {
+	render := renderApbYaml
+	if v.Format == formatJSON {
+		render = renderApbJSON
+	}
+	data, err := render(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// fieldMapping records where one piece of chart data landed in the bundle.
+type fieldMapping struct {
+	Source string
+	Target string
+	Value  string
+}
+
+// chartMappings describes how each chart field and values source was
+// transformed into the bundle generated from v.
+func chartMappings(v TarValues) []fieldMapping {
+	apb := NewAPB(v)
+	nameSource := "Chart.yaml name"
+	if len(v.BundleName) > 0 {
+		nameSource = "--name"
+	}
+	mappings := []fieldMapping{
+		{nameSource, "name", apb.Name},
+		{nameSource, "metadata.displayName", fmt.Sprint(apb.Metadata["displayName"])},
+		{"Chart.yaml name", "metadata.console.openshift.io/iconClass", fmt.Sprint(apb.Metadata["console.openshift.io/iconClass"])},
+		{"Chart.yaml description", "description", apb.Description},
+	}
+	planSource := "Chart.yaml name"
+	switch v.PlanDescription {
+	case "":
+	case v.Description:
+		planSource = "Chart.yaml description"
+	default:
+		planSource = "--plan-description"
+	}
+	if len(v.ImageURL) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml icon, via --embed-icon", "metadata.imageUrl", "(data URI)"})
+	} else if len(v.Chart.Icon) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml icon", "metadata.imageUrl", v.Chart.Icon})
+	}
+	if len(v.Chart.APIVersion) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml apiVersion", "metadata.chartApiVersion", v.Chart.APIVersion})
+	}
+	if len(v.Chart.Version) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml version", "metadata.chartVersion", v.Chart.Version})
+	}
+	if len(v.Chart.AppVersion) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml appVersion", "metadata.appVersion", v.Chart.AppVersion})
+	}
+	if len(v.Chart.KubeVersion) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml kubeVersion", "metadata.kubeVersion", v.Chart.KubeVersion})
+	}
+	if len(v.Chart.Maintainers) > 0 {
+		names := make([]string, len(v.Chart.Maintainers))
+		for i, m := range v.Chart.Maintainers {
+			names[i] = m.Name
+		}
+		mappings = append(mappings, fieldMapping{"Chart.yaml maintainers", "metadata.maintainers", strings.Join(names, ",")})
+	}
+	if len(v.Dependencies) > 0 {
+		names := make([]string, len(v.Dependencies))
+		for i, dep := range v.Dependencies {
+			names[i] = dep.Name
+		}
+		mappings = append(mappings, fieldMapping{"Chart.yaml/requirements.yaml dependencies, charts/", "metadata.dependencies", strings.Join(names, ",")})
+	}
+	if len(v.Tags) > 0 {
+		mappings = append(mappings, fieldMapping{"Chart.yaml keywords/annotations", "metadata.tags", strings.Join(v.Tags, ",")})
+	}
+	for i, plan := range apb.Plans {
+		descriptionSource, valuesSource, keySource := planSource, "values file", "values key"
+		values, parameters := v.Values, v.Parameters
+		if i > 0 {
+			// the plans after the default one come from --plan, in order
+			extra := v.Plans[i-1]
+			descriptionSource = fmt.Sprintf("Chart.yaml name, --plan %s", extra.Name)
+			valuesSource = fmt.Sprintf("--plan file %s", extra.File)
+			keySource = fmt.Sprintf("--plan file %s key", extra.File)
+			values, parameters = extra.Values, extra.Parameters
+		}
+		mappings = append(mappings, fieldMapping{descriptionSource, fmt.Sprintf("plans[%s].description", plan.Name), plan.Description})
+		for _, p := range plan.Parameters {
+			source, value := valuesSource, fmt.Sprintf("%d bytes", len(values))
+			if len(parameters) > 0 {
+				source, value = fmt.Sprintf("%s %s", keySource, p.Name), fmt.Sprint(p.Default)
+			}
+			mappings = append(mappings, fieldMapping{
+				source,
+				fmt.Sprintf("plans[%s].parameters[%s].default", plan.Name, p.Name),
+				value,
+			})
+		}
+	}
+	if len(v.TarfileName) > 0 {
+		mappings = append(mappings, fieldMapping{"chart archive", "Dockerfile COPY", v.TarfileName})
+	}
+	return mappings
+}
+
+// reportMappings writes the mapping report for v to stdout if o asks for one.
+func reportMappings(o options, v TarValues) error {
+	if !o.mappingReport {
+		return nil
+	}
+	err := writeMappingReport(os.Stdout, v)
+	if err != nil {
+		return fmt.Errorf("could not write mapping report: %v", err)
+	}
+	return nil
+}
+
+// writeMappingReport writes a table of chartMappings to w.
+func writeMappingReport(w io.Writer, v TarValues) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tTARGET\tVALUE")
+	for _, m := range chartMappings(v) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.Source, m.Target, m.Value)
+	}
+	return tw.Flush()
+}
+
+// diffCharts returns a unified diff between the apb.yml documents that
+// converting two charts according to o would generate.
+func diffCharts(oldFilename, newFilename string, o options) (string, error) {
+	err := o.validate()
+	if err != nil {
+		return "", err
+	}
+	var docs, names [2]string
+	for i, filename := range []string{oldFilename, newFilename} {
+		logger.file = filename
+		values, err := getChartValues(filename, o.chartReadOpts())
+		if err == nil {
+			values, err = prepareValues(values, o)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", filename, err)
+		}
+		data, err := renderApbYaml(values)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", filename, err)
+		}
+		docs[i] = string(data)
+		// name each side by its chart version too, so that a version bump is
+		// visible even when the file names do not say
+		names[i] = fmt.Sprintf("%s (%s %s)", filename, values.Chart.Name, values.Chart.Version)
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(docs[0]),
+		B:        difflib.SplitLines(docs[1]),
+		FromFile: names[0],
+		ToFile:   names[1],
+		Context:  3,
+	})
+}
+
+// validateChart checks that the chart at filename would convert according to
+// o: that its Chart.yaml and values file both parse, and that it passes the
+// same checks and parameter generation as run. It writes a summary of what
+// was found to w.
+func validateChart(w io.Writer, filename string, o options) error {
+	// check the whole conversion, not just the Chart.yaml that
+	// --emit-chart-json would print
+	o.emitChartJSON = false
+	err := o.validate()
+	if err != nil {
+		return err
+	}
+	logger.file = filename
+	values, err := getChartValues(filename, o.chartReadOpts())
+	if err != nil {
+		return err
+	}
+	// binary values cannot be parsed, and prepareValues decides whether they
+	// may be embedded anyway
+	binary := isBinary(values.Values)
+	values, err = prepareValues(values, o)
+	if err != nil {
+		return err
+	}
+	if !binary {
+		var parsed yaml.MapSlice
+		err = yaml.Unmarshal([]byte(values.Values), &parsed)
+		if err != nil {
+			return fmt.Errorf("%s: %v", o.valuesName, err)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "name:\t%s\n", values.Name)
+	fmt.Fprintf(tw, "description:\t%s\n", values.Description)
+	fmt.Fprintf(tw, "icon:\t%s\n", values.Chart.Icon)
+	return tw.Flush()
+}
+
+// extractChartFiles writes the chart's Chart.yaml and values file, exactly as
+// they were found in the archive, into dir. Files that were not found are
+// skipped, and existing files are only replaced when force is true.
+func extractChartFiles(v TarValues, dir, valuesName string, force bool) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"Chart.yaml", v.ChartYaml},
+		{valuesName, v.Values},
+	}
+	for _, file := range files {
+		if len(file.content) == 0 {
+			continue
+		}
+		target := filepath.Join(dir, file.name)
+		if !force {
+			_, err := os.Stat(target)
+			if err == nil {
+				return fmt.Errorf("use --force to overwrite existing %s", target)
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = ioutil.WriteFile(target, []byte(file.content), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildScriptFuncs are the functions available to buildScriptTemplate.
+var buildScriptFuncs = template.FuncMap{
+	"shellQuote": shellQuote,
+	"runtimes": func() string {
+		return strings.Join(containerRuntimes, " ")
+	},
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// writeBuildScript writes a shell script to w that builds the bundle image.
+func writeBuildScript(w io.Writer, v TarValues) error {
+	t, err := template.New(buildScript).Funcs(buildScriptFuncs).Parse(buildScriptTemplate)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, v)
+}
+
+// writeBundleCR writes a custom resource manifest containing the APB to w.
+func writeBundleCR(w io.Writer, v TarValues) error {
+	data, err := marshalYaml(NewBundleCR(v), v.OmitEmpty)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// dockerfileFuncs are the functions available to Dockerfile templates.
+var dockerfileFuncs = template.FuncMap{
+	"labelValue": labelValue,
+}
+
+// labelValue escapes s for use between the double quotes of a LABEL value.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// sourceDateEpochEnv is the environment variable that, by the reproducible
+// builds convention, holds the time to record as when the output was made.
+const sourceDateEpochEnv string = "SOURCE_DATE_EPOCH"
+
+// sourceDateEpoch returns the time in sourceDateEpochEnv in RFC 3339 format,
+// or "" if it is not set, so that Dockerfiles are the same from run to run
+// unless a time is asked for.
+func sourceDateEpoch() (string, error) {
+	epoch := os.Getenv(sourceDateEpochEnv)
+	if len(epoch) == 0 {
+		return "", nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: must be a number of seconds since 1970", sourceDateEpochEnv, epoch)
+	}
+	return time.Unix(seconds, 0).UTC().Format(time.RFC3339), nil
+}
+
+// writeDockerfile writes a Dockerfile to w that can be used to build a service
+// bundle. The same spec that goes into apb.yml is embedded in the image label.
+func writeDockerfile(w io.Writer, v TarValues) error {
+	text := dockerfileTemplate
+	if len(v.DockerfileTemplate) > 0 {
+		text = v.DockerfileTemplate
+	}
+	t, err := template.New(dockerfile).Funcs(dockerfileFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+
+	spec, err := renderApbYaml(v)
+	if err != nil {
+		return err
+	}
+	// standard base64 has no line breaks, so the label stays on one line
+	v.EncodedSpec = base64.StdEncoding.EncodeToString(spec)
+
+	return t.Execute(w, v)
+}
+
+// catalogTags merges the chart's keywords with the comma-separated tags in the
+// named annotation, if one is named, dropping empty and duplicate entries
+// while keeping the order in which they first appear.
+func catalogTags(c Chart, annotation string) []string {
+	candidates := append([]string{}, c.Keywords...)
+	if len(annotation) > 0 {
+		candidates = append(candidates, strings.Split(c.Annotations[annotation], ",")...)
+	}
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range candidates {
+		tag = strings.TrimSpace(tag)
+		if len(tag) == 0 || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// chartHelmVersion returns the major version of helm that a chart was written
+// for, based on its apiVersion. Charts without an apiVersion predate Helm 3.
+func chartHelmVersion(c Chart) (int, error) {
+	switch c.APIVersion {
+	case "", "v1":
+		return 2, nil
+	case "v2":
+		return 3, nil
+	}
+	return 0, fmt.Errorf("unrecognized chart apiVersion %q", c.APIVersion)
+}
+
+// checkHelmVersion returns an error if the chart cannot be used with the
+// given major version of helm, or if it is not known which one it needs.
+func checkHelmVersion(c Chart, helmVersion int) error {
+	chartHelm, err := chartHelmVersion(c)
+	if err != nil {
+		return err
+	}
+	if chartHelm != helmVersion {
+		return fmt.Errorf("chart %s has apiVersion %q and requires Helm %d, but the base image uses Helm %d", c.Name, c.APIVersion, chartHelm, helmVersion)
+	}
+	return nil
+}
+
+// writeChartJSON writes the parsed chart to w as indented JSON. Characters
+// such as the ">" of a kubeVersion constraint are written as they are rather
+// than escaped for HTML.
+func writeChartJSON(w io.Writer, c Chart) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+// readOptions controls how getTarValues reads a chart archive.
+type readOptions struct {
+	// bestEffort causes a missing values.yaml or chart name to be replaced
+	// with placeholder data and a warning instead of causing an error.
+	bestEffort bool
+	// valuesName is the name of the file at the chart root that supplies the
+	// chart's default values.
+	valuesName string
+	// readme causes the chart's README.md to be read as well.
+	readme bool
+	// schema causes the chart's values.schema.json to be read as well.
+	schema bool
+	// maxDecompressedSize is the most bytes that may be read from the
+	// uncompressed tar stream, or 0 for no limit.
+	maxDecompressedSize int64
+	// maxFileSize is the most bytes that may be read from each file in the
+	// chart, or 0 for no limit.
+	maxFileSize int64
+	// dependencies causes the chart's requirements.yaml and the contents of
+	// its charts/ directory to be read as well. The rest of the archive is
+	// only scanned for them once the chart declares dependencies in
+	// Chart.yaml or a requirements.yaml or charts/ entry has been seen, so
+	// ones that only appear after the chart's other files are missed.
+	dependencies bool
+	// extraFiles are the names of other files to read from the chart root.
+	extraFiles []string
+	// skipValues causes the values file to be found but not read, leaving
+	// Values empty, for callers that only need Chart.yaml.
+	skipValues bool
+}
+
+// getTarValues opens the helm chart tarball to 1) retrieve Chart.yaml so it can
+// be parsed, and 2) retrieve the entire contents of values.yaml, or of the file
+// named by opts.valuesName.
+func getTarValues(filename string, opts readOptions) (TarValues, error) {
+	if !hasChartExtension(filename) {
+		logger.Warnf("%s does not end in .tgz or .tar.gz, the extensions used for helm charts", filename)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return TarValues{}, err
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	// a short read just means the file is too small to be either; the tar
+	// reader reports that below
+	magic, _ := br.Peek(len(zipMagic))
+	if string(magic) == zipMagic {
+		return TarValues{}, fmt.Errorf("%s is a zip archive, not a gzipped tar; helm charts must be packaged with \"helm package\"", filename)
+	}
+
+	var archive io.Reader = br
+	if strings.HasPrefix(string(magic), gzipMagic) {
+		uncompressed, err := gzip.NewReader(br)
+		if err != nil {
+			return TarValues{}, fmt.Errorf("input file %s does not appear to be a gzipped helm chart (.tgz): %v", filename, err)
+		}
+		archive = uncompressed
+	}
+	if opts.maxDecompressedSize > 0 {
+		archive = &sizeLimitedReader{r: archive, remaining: opts.maxDecompressedSize, limit: opts.maxDecompressedSize}
+	}
+
+	tr := tar.NewReader(archive)
+	entries := 0
+	// the files found in each directory of the archive, and the order in
+	// which the directories were seen
+	found := make(map[string]*chartFiles)
+	var dirs []string
+	// the subcharts found in the charts/ directory below each directory
+	subcharts := make(map[string][]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && entries == 0 {
+			return TarValues{}, fmt.Errorf("input file %s does not appear to be a gzipped helm chart (.tgz): %v", filename, err)
+		}
+		if err != nil {
+			return TarValues{}, err
+		}
+		entries++
+
+		cleaned := path.Clean(hdr.Name)
+		if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return TarValues{}, fmt.Errorf("%s has an entry %q outside of the archive root", filename, hdr.Name)
+		}
+		if opts.dependencies {
+			if parent, name, ok := subchartOf(cleaned); ok {
+				subcharts[parent] = appendUnique(subcharts[parent], name)
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			// never read chart files through symlinks or other special
+			// entries
+			continue
+		}
+		dir, name := path.Split(cleaned)
+		dir = strings.TrimSuffix(dir, "/")
+		if inSubchart(dir) {
+			continue
+		}
+		files, ok := found[dir]
+		if !ok {
+			files = &chartFiles{}
+			found[dir] = files
+			dirs = append(dirs, dir)
+		}
+		content := files.named(name, opts)
+		if content == nil {
+			continue
+		}
+		if content == &files.values && opts.skipValues {
+			// only whether there are values matters
+			files.valuesSkipped = hdr.Size > 0
+			logger.Debugf("found %s (%d bytes) in %s", hdr.Name, hdr.Size, filename)
+		} else {
+			data, err := readChartFile(tr, hdr.Name, opts.maxFileSize)
+			if err != nil {
+				return TarValues{}, err
+			}
+			*content = string(data)
+			logger.Debugf("read %s (%d bytes) from %s", hdr.Name, len(data), filename)
+		}
+
+		// nothing can be shallower than the usual single top-level
+		// directory, so stop reading the archive as soon as it is complete
+		if archiveDepth(dir) <= 1 && len(files.chartYaml) > 0 && files.hasValues() && files.haveOptional(opts) && !files.hasDependencies(opts, subcharts[dir]) {
+			break
+		}
+	}
+
+	var files chartFiles
+	root, ok := chartRoot(found, dirs)
+	if ok {
+		files = *found[root]
+		logger.Debugf("using the chart in directory %q of %s", root, filename)
+	}
+	var chart Chart
+	if len(files.chartYaml) > 0 {
+		chart, err = parseChart(strings.NewReader(files.chartYaml))
+		if err != nil {
+			return TarValues{}, err
+		}
+	}
+	if !opts.bestEffort && (!files.hasValues() || len(chart.Name) == 0) {
+		if len(chart.Name) > 0 {
+			return TarValues{}, fmt.Errorf("%s not found in archive", opts.valuesName)
+		}
+		return TarValues{}, errors.New("Chart.yaml not found in archive")
+	}
+	v, err := chartTarValues(filename, chart, files, opts)
+	v.Subcharts = subcharts[root]
+	return v, err
+}
+
+// chartExtensions are the extensions that chart archives are given.
+// Uncompressed .tar files are included, since --context-chart-compress=false
+// produces them.
+var chartExtensions = []string{".tgz", ".tar.gz", ".tar"}
+
+// chartExtension returns the extension of filename that is one of
+// chartExtensions, ignoring case, as it is written in filename. It returns ""
+// if filename has none of them.
+func chartExtension(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, ext := range chartExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return filename[len(filename)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// hasChartExtension returns true if filename ends in one of the extensions
+// that chart archives are given, ignoring case.
+func hasChartExtension(filename string) bool {
+	return len(chartExtension(filename)) > 0
+}
+
+// chartFiles holds the raw contents of the files read from a chart. Each is
+// empty if the file was not found.
+type chartFiles struct {
+	chartYaml    string
+	values       string
+	readme       string
+	schema       string
+	requirements string
+	extra        map[string]*string
+
+	// valuesSkipped is true when a non-empty values file was found but, as
+	// requested, not read.
+	valuesSkipped bool
+}
+
+// optionalFile is a file that is only read from a chart when an option needs
+// it, along with where its contents are stored.
+type optionalFile struct {
+	name    string
+	content *string
+}
+
+// optional returns the optional files that opts asks to be read.
+func (f *chartFiles) optional(opts readOptions) []optionalFile {
+	var files []optionalFile
+	if opts.readme {
+		files = append(files, optionalFile{"README.md", &f.readme})
+	}
+	if opts.schema {
+		files = append(files, optionalFile{valuesSchemaName, &f.schema})
+	}
+	for _, name := range opts.extraFiles {
+		if f.extra == nil {
+			f.extra = make(map[string]*string)
+		}
+		if f.extra[name] == nil {
+			f.extra[name] = new(string)
+		}
+		files = append(files, optionalFile{name, f.extra[name]})
+	}
+	return files
+}
+
+// extraFiles returns the contents of the extra files that were read, by name.
+func (f *chartFiles) extraFiles() map[string]string {
+	if len(f.extra) == 0 {
+		return nil
+	}
+	contents := make(map[string]string, len(f.extra))
+	for name, content := range f.extra {
+		contents[name] = *content
+	}
+	return contents
+}
+
+// haveOptional returns true once every optional file that opts asks for has
+// been read, so that scanning the archive can stop.
+func (f *chartFiles) haveOptional(opts readOptions) bool {
+	for _, optional := range f.optional(opts) {
+		if len(*optional.content) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// named returns where the contents of the chart file called name are stored,
+// or nil if it is not a file that opts asks to be read.
+func (f *chartFiles) named(name string, opts readOptions) *string {
+	switch name {
+	case "Chart.yaml":
+		return &f.chartYaml
+	case opts.valuesName:
+		return &f.values
+	}
+	if opts.dependencies && name == requirementsName {
+		return &f.requirements
+	}
+	for _, optional := range f.optional(opts) {
+		if optional.name == name {
+			return optional.content
+		}
+	}
+	return nil
+}
+
+// hasDependencies returns true if opts asks for dependencies and there is
+// any sign that the chart has some: a requirements.yaml, subcharts found so
+// far, or dependencies declared in its Chart.yaml.
+func (f *chartFiles) hasDependencies(opts readOptions, subcharts []string) bool {
+	if !opts.dependencies {
+		return false
+	}
+	if len(f.requirements) > 0 || len(subcharts) > 0 {
+		return true
+	}
+	var declared struct {
+		Dependencies []Dependency `yaml:"dependencies"`
+	}
+	// a Chart.yaml that does not parse is reported once the scan is done
+	yaml.Unmarshal([]byte(f.chartYaml), &declared)
+	return len(declared.Dependencies) > 0
+}
+
+// hasValues returns true if a non-empty values file was found.
+func (f *chartFiles) hasValues() bool {
+	return len(f.values) > 0 || f.valuesSkipped
+}
+
+// empty returns true if no chart files were found.
+func (f *chartFiles) empty() bool {
+	for _, name := range f.extra {
+		if len(*name) > 0 {
+			return false
+		}
+	}
+	return len(f.chartYaml) == 0 && !f.hasValues() && len(f.readme) == 0 && len(f.schema) == 0 && len(f.requirements) == 0
+}
+
+// chartRoot returns the directory of a chart archive that holds the chart
+// itself: the shallowest one with a Chart.yaml, or failing that, the shallowest
+// one with any chart files at all. Ties go to the directory seen first.
+func chartRoot(found map[string]*chartFiles, dirs []string) (string, bool) {
+	root, ok := "", false
+	for _, requireChart := range []bool{true, false} {
+		for _, dir := range dirs {
+			files := found[dir]
+			if requireChart && len(files.chartYaml) == 0 {
+				continue
+			}
+			if files.empty() {
+				continue
+			}
+			if !ok || archiveDepth(dir) < archiveDepth(root) {
+				root, ok = dir, true
+			}
+		}
+		if ok {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// archiveDepth returns how many directories deep dir is within an archive.
+func archiveDepth(dir string) int {
+	if len(dir) == 0 {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// subchartOf returns the name of the subchart that the archive entry at p
+// belongs to, and the directory of the chart that bundles it, if p is within
+// a charts/ directory. Packaged subcharts are named without their extension.
+func subchartOf(p string) (string, string, bool) {
+	parts := strings.Split(p, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "charts" {
+			name := strings.TrimSuffix(parts[i+1], chartExtension(parts[i+1]))
+			return strings.Join(parts[:i], "/"), name, true
+		}
+	}
+	return "", "", false
+}
+
+// containsString returns true if list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends s to list unless it is already there.
+func appendUnique(list []string, s string) []string {
+	if containsString(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+// inSubchart returns true if dir is within a subchart, which lives in the
+// charts/ directory of its parent chart.
+func inSubchart(dir string) bool {
+	parts := strings.Split(dir, "/")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "charts" {
+			return true
+		}
+	}
+	return false
+}
+
+// readChartFile reads the chart file called name from r, failing if it holds
+// more than limit bytes, unless limit is 0.
+func readChartFile(r io.Reader, name string, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than the maximum file size of %d bytes", name, limit)
+	}
+	return data, nil
+}
+
+// readDirFile reads the file at filename in a chart directory, with the same
+// limit as readChartFile.
+func readDirFile(filename string, limit int64) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readChartFile(f, filename, limit)
+}
+
+// sizeLimitedReader reads from r until limit bytes have been read, and then
+// fails with an error if r has any more data. Unlike io.LimitReader, this
+// never silently truncates the stream.
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// only an error if there is something left to read
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, fmt.Errorf("chart archive is larger than the maximum decompressed size of %d bytes", l.limit)
+		}
+		// io.Reader allows (0, nil), which says nothing about what is left
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// getDirValues reads Chart.yaml, the values file and any optional files that
+// opts asks for from an unpacked chart directory.
+func getDirValues(dir string, opts readOptions) (TarValues, error) {
+	var chart Chart
+	var files chartFiles
+	if opts.skipValues {
+		info, err := os.Stat(filepath.Join(dir, opts.valuesName))
+		if err != nil && !os.IsNotExist(err) {
+			return TarValues{}, err
+		}
+		files.valuesSkipped = err == nil && info.Size() > 0
+	}
+	for _, required := range []optionalFile{{"Chart.yaml", &files.chartYaml}, {opts.valuesName, &files.values}} {
+		if required.content == &files.values && opts.skipValues {
+			if !files.valuesSkipped && !opts.bestEffort {
+				return TarValues{}, fmt.Errorf("%s not found in directory %s", required.name, dir)
+			}
+			continue
+		}
+		data, err := readDirFile(filepath.Join(dir, required.name), opts.maxFileSize)
+		if os.IsNotExist(err) && opts.bestEffort {
+			continue
+		}
+		if os.IsNotExist(err) {
+			return TarValues{}, fmt.Errorf("%s not found in directory %s", required.name, dir)
+		}
+		if err != nil {
+			return TarValues{}, err
+		}
+		*required.content = string(data)
+		logger.Debugf("read %s (%d bytes) from %s", required.name, len(data), dir)
+	}
+	for _, optional := range files.optional(opts) {
+		data, err := readDirFile(filepath.Join(dir, optional.name), opts.maxFileSize)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return TarValues{}, err
+		}
+		*optional.content = string(data)
+	}
+	var subcharts []string
+	if opts.dependencies {
+		data, err := readDirFile(filepath.Join(dir, requirementsName), opts.maxFileSize)
+		if err != nil && !os.IsNotExist(err) {
+			return TarValues{}, err
+		}
+		files.requirements = string(data)
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "charts"))
+		if err != nil && !os.IsNotExist(err) {
+			return TarValues{}, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || hasChartExtension(entry.Name()) {
+				subcharts = append(subcharts, strings.TrimSuffix(entry.Name(), chartExtension(entry.Name())))
+			}
+		}
+	}
+	if len(files.chartYaml) > 0 {
+		var err error
+		chart, err = parseChart(strings.NewReader(files.chartYaml))
+		if err != nil {
+			return TarValues{}, err
+		}
+	}
+	v, err := chartTarValues(dir, chart, files, opts)
+	v.Subcharts = subcharts
+	return v, err
+}
+
+// getChartValues reads a chart from either a chart archive or an unpacked
+// chart directory.
+func getChartValues(filename string, opts readOptions) (TarValues, error) {
+	if isDir(filename) {
+		return getDirValues(filename, opts)
+	}
+	return getTarValues(filename, opts)
+}
+
+// httpTimeout is the longest that any single download may take.
+const httpTimeout = 2 * time.Minute
+
+// httpClient is used for every download, so that an unreachable server makes
+// it fail rather than hang.
+var httpClient = &http.Client{Timeout: httpTimeout}
+
+// isURL returns true if the chart argument is an http or https URL rather than
+// a local path.
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// fetchChart downloads the chart at rawURL into a new temporary directory,
+// naming the file after the last element of the URL's path so that it lands
+// in the build context under a sensible name. It returns the temporary
+// directory, which the caller should remove, and the path of the downloaded
+// chart.
+func fetchChart(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "chart.tgz"
+	}
+
+	dir, err := ioutil.TempDir("", "helm2bundle")
+	if err != nil {
+		return "", "", err
+	}
+	filename := filepath.Join(dir, name)
+	err = downloadFile(rawURL, filename)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return dir, filename, nil
+}
+
+// downloadFile saves the body of a GET request for rawURL to filename.
+func downloadFile(rawURL, filename string) error {
+	resp, err := httpClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: server responded %s", rawURL, resp.Status)
+	}
+
+	f, err := os.Create(filename)
+	if err == nil {
+		_, err = io.Copy(f, resp.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("fetching %s: %v", rawURL, err)
+	}
+	return nil
+}
+
+// maxIconSize is the largest icon that --embed-icon will embed.
+const maxIconSize = 1 << 20
+
+// fetchIcon downloads the image at iconURL and returns it as a base64 data URI.
+func fetchIcon(iconURL string) (string, error) {
+	resp, err := httpClient.Get(iconURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: server responded %s", iconURL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIconSize+1))
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %v", iconURL, err)
+	}
+	if len(data) > maxIconSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", iconURL, maxIconSize)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = http.DetectContentType(data)
+	}
+	return fmt.Sprintf("data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// isDir returns true if filename names a directory.
+func isDir(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && info.IsDir()
+}
+
+// chartTarValues assembles the TarValues for the chart found at filename from
+// the contents of its files.
+func chartTarValues(filename string, chart Chart, files chartFiles, opts readOptions) (TarValues, error) {
+	if opts.bestEffort {
+		if len(chart.Name) == 0 {
+			chart.Name = placeholderName(filename)
+			logger.Warnf("chart name not found, using %q", chart.Name)
+		}
+		if !files.hasValues() {
+			logger.Warnf("%s not found or empty, using empty values", opts.valuesName)
+		}
+	} else if !files.hasValues() || len(chart.Name) == 0 {
+		return TarValues{}, fmt.Errorf("Could not find both Chart.yaml and %s", opts.valuesName)
+	}
+	return TarValues{
+		Name:         chart.Name,
+		Description:  chart.Description,
+		TarfileName:  filename,
+		Values:       files.values,
+		ChartYaml:    files.chartYaml,
+		Readme:       files.readme,
+		Schema:       files.schema,
+		Requirements: files.requirements,
+		ExtraFiles:   files.extraFiles(),
+		Chart:        chart,
+	}, nil
+}
+
+// packagedName returns the filename that a chart directory is packaged as,
+// following the NAME-VERSION.tgz convention of "helm package". Uncompressed
+// packages end in .tar instead.
+func packagedName(v TarValues, compress bool) string {
+	name := v.Name
+	if len(v.Chart.Version) > 0 {
+		name = fmt.Sprintf("%s-%s", v.Name, v.Chart.Version)
+	}
+	if compress {
+		return name + ".tgz"
+	}
+	return name + ".tar"
+}
+
+// normalizeValues parses the contents of a values.yaml file and marshals it
+// again, so that indentation is consistent. Key order is preserved, but
+// comments are lost.
+func normalizeValues(values string) (string, error) {
+	if len(values) == 0 {
+		return values, nil
+	}
+	var parsed yaml.MapSlice
+	err := yaml.Unmarshal([]byte(values), &parsed)
+	if err != nil {
+		return "", err
+	}
+	data, err := yaml.Marshal(parsed)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// isBinary returns true if data is not valid UTF-8 text or contains NUL bytes,
+// which no YAML file does.
+func isBinary(data string) bool {
+	return !utf8.ValidString(data) || strings.ContainsRune(data, 0)
+}
+
+// readmeDescription returns the first line of a markdown README that is not
+// blank or part of a heading.
+func readmeDescription(readme string) string {
+	lines := strings.Split(readme, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i+1 < len(lines) && isSetextUnderline(lines[i+1]) {
+			// skip a setext-style heading along with its underline
+			i++
+			continue
+		}
+		return line
+	}
+	return ""
+}
+
+// isSetextUnderline returns true if line is made up only of "=" or "-"
+// characters, which makes the line above it a heading.
+func isSetextUnderline(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) > 0 && (strings.Trim(line, "=") == "" || strings.Trim(line, "-") == "")
+}
+
+// mergeValuesFiles deep-merges each of the named values files, in order, over
+// the chart's values and returns the result as YAML.
+func mergeValuesFiles(values string, filenames []string) (string, error) {
+	var merged yaml.MapSlice
+	err := yaml.Unmarshal([]byte(values), &merged)
+	if err != nil {
+		return "", err
+	}
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		var overlay yaml.MapSlice
+		err = yaml.Unmarshal(data, &overlay)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", filename, err)
+		}
+		merged = mergeValues(merged, overlay)
+	}
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// mergeValues deep-merges overlay over base following helm's rules: maps are
+// merged key by key, any other value replaces the one beneath it, and a null
+// value removes the key. Keys keep the position they have in base, and new
+// keys are added at the end.
+func mergeValues(base, overlay yaml.MapSlice) yaml.MapSlice {
+	merged := append(yaml.MapSlice{}, base...)
+	for _, item := range overlay {
+		i := 0
+		for i < len(merged) && merged[i].Key != item.Key {
+			i++
+		}
+		switch {
+		case item.Value == nil && i < len(merged):
+			merged = append(merged[:i], merged[i+1:]...)
+		case item.Value == nil:
+		case i == len(merged):
+			merged = append(merged, item)
+		default:
+			baseMap, baseIsMap := merged[i].Value.(yaml.MapSlice)
+			overlayMap, overlayIsMap := item.Value.(yaml.MapSlice)
+			if baseIsMap && overlayIsMap {
+				merged[i].Value = mergeValues(baseMap, overlayMap)
+			} else {
+				merged[i].Value = item.Value
+			}
+		}
+	}
+	return merged
+}
+
+// expandParameters returns one Parameter for each top-level key in the
+// contents of a values.yaml file. Each parameter's type is inferred from its
+// value; maps and lists are offered as YAML in a textarea.
+func expandParameters(values string) ([]Parameter, error) {
+	var parsed yaml.MapSlice
+	err := yaml.Unmarshal([]byte(values), &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters := make([]Parameter, 0, len(parsed))
+	for _, item := range parsed {
+		name := fmt.Sprint(item.Key)
+		p := Parameter{
+			Name:    name,
+			Title:   titleCase(name),
+			Type:    "string",
+			Default: item.Value,
+		}
+		switch value := item.Value.(type) {
+		case bool:
+			p.Type = "boolean"
+		case int, int64, uint64:
+			p.Type = "int"
+		case float64:
+			p.Type = "number"
+		case string:
+		case nil:
+			p.Default = ""
+		default:
+			// nested maps and lists
+			data, err := yaml.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			p.DisplayType = "textarea"
+			p.Default = string(data)
+		}
+		parameters = append(parameters, p)
+	}
+	return parameters, nil
+}
+
+// applySchema sets Required on each parameter that the top level of a
+// values.schema.json document lists as required, and copies the pattern and
+// enum constraints of the matching schema property.
+func applySchema(parameters []Parameter, schema string) error {
+	var parsed struct {
+		Required   []string                  `json:"required"`
+		Properties map[string]schemaProperty `json:"properties"`
+	}
+	err := json.Unmarshal([]byte(schema), &parsed)
+	if err != nil {
+		return fmt.Errorf("%s: %v", valuesSchemaName, err)
+	}
+	for i := range parameters {
+		p := &parameters[i]
+		p.Required = p.Required || containsString(parsed.Required, p.Name)
+		if prop, ok := parsed.Properties[p.Name]; ok {
+			p.Pattern = prop.Pattern
+			p.Enum = prop.Enum
+		}
+	}
+	return nil
+}
+
+// valuesParameters returns the parameters generated for a plan whose default
+// values are values: one per top-level key when expand is true, one per
+// schema property when the chart has a schema, and otherwise none, which
+// leaves the plan with the single "values" parameter.
+func valuesParameters(values, schema string, expand bool) ([]Parameter, error) {
+	if expand {
+		parameters, err := expandParameters(values)
+		if err == nil && len(schema) > 0 {
+			err = applySchema(parameters, schema)
+		}
+		return parameters, err
+	}
+	if len(schema) > 0 {
+		return schemaParameters(schema, values)
+	}
+	return nil, nil
+}
+
+// parsePlanArg splits a --plan argument of the form LABEL=FILE.
+func parsePlanArg(arg string) (string, string, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("invalid --plan %q: must be LABEL=FILE", arg)
+	}
+	if len(parts[0]) > 63 || !dnsLabelPattern.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("invalid --plan label %q: must be a DNS label", parts[0])
+	}
+	return parts[0], parts[1], nil
+}
+
+// planValuesFile returns the contents of a plan's values file, read from disk
+// if it exists there, and otherwise from the root of the chart.
+func planValuesFile(file string, v TarValues) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if content, ok := v.ExtraFiles[file]; ok && len(content) > 0 {
+		return content, nil
+	}
+	return "", fmt.Errorf("%s not found on disk or in the chart", file)
+}
+
+// schemaProperty is the part of a JSON Schema property that parameters are
+// generated from.
+type schemaProperty struct {
+	Type        interface{}   `json:"type"` // a type name or a list of them
+	Description string        `json:"description"`
+	Default     interface{}   `json:"default"`
+	Pattern     string        `json:"pattern"`
+	Enum        []interface{} `json:"enum"`
+}
+
+// typeName returns the property's type, or the first one other than "null"
+// when it lists several. It returns "" when there is no usable type.
+func (p schemaProperty) typeName() string {
+	switch t := p.Type.(type) {
+	case string:
+		return t
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok && name != "null" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// schemaParameters returns one parameter for each top-level property in a
+// values.schema.json document, typed according to the schema and titled with
+// its description. Defaults come from values, falling back to the schema's
+// own default. Properties are ordered as their keys appear in values, and any
+// that values lacks follow in alphabetical order.
+func schemaParameters(schema, values string) ([]Parameter, error) {
+	var parsed struct {
+		Properties map[string]schemaProperty `json:"properties"`
+	}
+	err := json.Unmarshal([]byte(schema), &parsed)
+	if err != nil {
+		return nil, err
+	}
+	var defaults yaml.MapSlice
+	err = yaml.Unmarshal([]byte(values), &defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	inValues := make(map[string]bool)
+	for _, item := range defaults {
+		name := fmt.Sprint(item.Key)
+		if _, ok := parsed.Properties[name]; ok {
+			names = append(names, name)
+			inValues[name] = true
+		}
+	}
+	var rest []string
+	for name := range parsed.Properties {
+		if !inValues[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	parameters := make([]Parameter, 0, len(names))
+	for _, name := range names {
+		prop := parsed.Properties[name]
+		p := Parameter{
+			Name:    name,
+			Title:   prop.Description,
+			Type:    "string",
+			Default: prop.Default,
+		}
+		if len(p.Title) == 0 {
+			p.Title = titleCase(name)
+		}
+		for _, item := range defaults {
+			if fmt.Sprint(item.Key) == name {
+				p.Default = item.Value
+			}
+		}
+		typ := prop.typeName()
+		if len(typ) == 0 {
+			typ = schemaType(p.Default)
+		}
+		switch typ {
+		case "boolean":
+			p.Type = "boolean"
+		case "integer":
+			p.Type = "int"
+		case "number":
+			p.Type = "number"
+		case "string":
+		default:
+			// objects, arrays, and types that parameters cannot express
+			// are edited as YAML
+			p.DisplayType = "textarea"
+			if p.Default != nil {
+				data, err := yaml.Marshal(p.Default)
+				if err != nil {
+					return nil, err
+				}
+				p.Default = string(data)
+			}
+		}
+		if p.Default == nil {
+			p.Default = zeroDefault(p.Type)
+		}
+		parameters = append(parameters, p)
+	}
+	return parameters, applySchema(parameters, schema)
+}
+
+// schemaType returns the JSON Schema type of a value parsed from YAML, for
+// properties that do not declare one.
+func schemaType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "boolean"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case string, nil:
+		return "string"
+	}
+	return "object"
+}
+
+// zeroDefault returns the default given to a parameter of type typ that has
+// none, which is the zero value of that type.
+func zeroDefault(typ string) interface{} {
+	switch typ {
+	case "boolean":
+		return false
+	case "int", "number":
+		return 0
+	}
+	return ""
+}
+
+// titleCase turns a values key such as "serviceType" or "use_password" into a
+// title such as "Service Type" or "Use Password".
+func titleCase(key string) string {
+	var words []string
+	var word []rune
+	for i, r := range key {
+		switch {
+		case r == '_' || r == '-' || r == '.' || r == ' ':
+			if len(word) > 0 {
+				words = append(words, string(word))
+			}
+			word = nil
+			continue
+		case unicode.IsUpper(r) && i > 0 && len(word) > 0 && !unicode.IsUpper(word[len(word)-1]):
+			words = append(words, string(word))
+			word = nil
+		}
+		if len(word) == 0 {
+			r = unicode.ToUpper(r)
+		}
+		word = append(word, r)
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return strings.Join(words, " ")
+}
+
+// placeholderName derives a chart name from the tarball's filename, for use
+// when Chart.yaml does not provide one.
+func placeholderName(filename string) string {
+	name := path.Base(filename)
+	return strings.TrimSuffix(name, chartExtension(name))
 }
 
 // parseChart parses the Chart.yaml file for data that is needed when creating
@@ -0,0 +1,1998 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update rewrites the golden files in testdata with the current output.
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares got with the golden file testdata/name, or replaces the
+// file with got when -update is given.
+func checkGolden(t *testing.T, name string, got []byte) {
+	golden := filepath.Join("testdata", name)
+	if *update {
+		err := ioutil.WriteFile(golden, got, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output does not match %s; run go test -update to accept it\ngot:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+// tarEntry is one file to put in a test chart archive.
+type tarEntry struct {
+	name    string
+	content string
+}
+
+// chartArchive returns a tar archive of entries, gzipped when compress is
+// true.
+func chartArchive(t testing.TB, compress bool, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(e.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeChart writes a gzipped chart archive of entries to name in dir and
+// returns its path.
+func writeChart(t testing.TB, dir, name string, entries ...tarEntry) string {
+	filename := filepath.Join(dir, name)
+	err := ioutil.WriteFile(filename, chartArchive(t, true, entries...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// zipArchive returns a zip archive of entries.
+func zipArchive(t testing.TB, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err == nil {
+			_, err = w.Write([]byte(e.content))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// chartYaml returns a minimal Chart.yaml for a chart called name.
+func chartYaml(name, version string) string {
+	return "apiVersion: v1\nname: " + name + "\nversion: " + version + "\ndescription: A test chart\n"
+}
+
+func TestDiffChartsVersionBump(t *testing.T) {
+	dir := t.TempDir()
+	oldChart := writeChart(t, dir, "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	newChart := writeChart(t, dir, "redis-1.1.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.1.0")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+
+	diff, err := diffCharts(oldChart, newChart, testOptions(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"--- " + oldChart + " (redis 1.0.0)\n",
+		"+++ " + newChart + " (redis 1.1.0)\n",
+		"-  chartVersion: 1.0.0\n",
+		"+  chartVersion: 1.1.0\n",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, diff)
+		}
+	}
+
+	same, err := diffCharts(oldChart, oldChart, testOptions(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(same) != 0 {
+		t.Errorf("diff of a chart with itself is not empty:\n%s", same)
+	}
+}
+
+func TestDiffChartsPreparedValues(t *testing.T) {
+	dir := t.TempDir()
+	oldChart := writeChart(t, dir, "redis-old.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0") + "keywords:\n- cache\n"},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	// the same chart, apart from its keywords and schema
+	newChart := writeChart(t, dir, "redis-new.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0") + "keywords:\n- database\n"},
+		tarEntry{"redis/values.yaml", "port: 6379\n"},
+		tarEntry{"redis/values.schema.json", `{"properties": {"port": {"type": "integer"}}}`})
+
+	diff, err := diffCharts(oldChart, newChart, testOptions(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"-  - cache\n",
+		"+  - database\n",
+		"+  - name: port\n",
+		"+    type: int\n",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, diff)
+		}
+	}
+
+	o := testOptions("")
+	o.plans = []string{"broken"}
+	_, err = diffCharts(oldChart, newChart, o)
+	if err == nil || !strings.Contains(err.Error(), "invalid --plan") {
+		t.Errorf("got error %v for an invalid --plan", err)
+	}
+}
+
+func TestGetTarValues(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// filename is what the archive is saved as, chart.tgz by default
+		filename string
+		archive  []byte
+		opts     readOptions
+		// wantName and wantValues are the chart name and values expected
+		// when wantErr is empty
+		wantName      string
+		wantValues    string
+		wantSubcharts []string
+		wantErr       string
+	}{
+		{
+			name: "chart",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			wantName:   "redis",
+			wantValues: "port: 6379\n",
+		},
+		{
+			name:    "no values",
+			archive: chartArchive(t, true, tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")}),
+			wantErr: "values.yaml not found in archive",
+		},
+		{
+			name:     "best effort without values",
+			archive:  chartArchive(t, true, tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")}),
+			opts:     readOptions{bestEffort: true},
+			wantName: "redis",
+		},
+		{
+			name:     "best effort without values or a name",
+			filename: "redis-1.0.0.tgz",
+			archive:  chartArchive(t, true, tarEntry{"redis/Chart.yaml", "version: 1.0.0\n"}),
+			opts:     readOptions{bestEffort: true},
+			wantName: "redis-1.0.0",
+		},
+		{
+			name:    "no name",
+			archive: chartArchive(t, true, tarEntry{"redis/Chart.yaml", "version: 1.0.0\n"}, tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			wantErr: "Chart.yaml not found in archive",
+		},
+		{
+			name:     "zip renamed to tgz",
+			filename: "redis-1.0.0.tgz",
+			archive:  zipArchive(t, tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")}, tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			wantErr:  "is a zip archive, not a gzipped tar",
+		},
+		{
+			name:       "uppercase extension",
+			filename:   "REDIS-1.0.0.TGZ",
+			archive:    chartArchive(t, true, tarEntry{"redis/Chart.yaml", "version: 1.0.0\n"}, tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			opts:       readOptions{bestEffort: true},
+			wantName:   "REDIS-1.0.0",
+			wantValues: "port: 6379\n",
+		},
+		{
+			name:     "uppercase subchart extension",
+			filename: "redis-1.0.0.Tar.Gz",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/charts/Common-0.1.0.TGZ", "not read"},
+				tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			opts:          readOptions{dependencies: true},
+			wantName:      "redis",
+			wantValues:    "port: 6379\n",
+			wantSubcharts: []string{"Common-0.1.0"},
+		},
+		{
+			name: "non-default values file",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", "port: 6379\n"},
+				tarEntry{"redis/values-prod.yaml", "port: 6380\n"}),
+			opts:       readOptions{valuesName: "values-prod.yaml"},
+			wantName:   "redis",
+			wantValues: "port: 6380\n",
+		},
+		{
+			name: "missing non-default values file",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			opts:    readOptions{valuesName: "values-prod.yaml"},
+			wantErr: "values-prod.yaml not found in archive",
+		},
+		{
+			// 8 MiB of zeros compresses to a few KiB
+			name: "decompression bomb",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/templates/bomb.yaml", strings.Repeat("\x00", 8<<20)},
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			opts:    readOptions{maxDecompressedSize: 1 << 20},
+			wantErr: "chart archive is larger than the maximum decompressed size of 1048576 bytes",
+		},
+		{
+			name: "oversized values",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", strings.Repeat("port: 6379\n", 1<<16)}),
+			opts:    readOptions{maxDecompressedSize: 100 << 20, maxFileSize: 1 << 16},
+			wantErr: "redis/values.yaml is larger than the maximum file size of 65536 bytes",
+		},
+		{
+			name: "subchart before its parent",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/charts/common/Chart.yaml", chartYaml("common", "0.1.0")},
+				tarEntry{"redis/charts/common/values.yaml", "common: true\n"},
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", "port: 6379\n"}),
+			opts:          readOptions{dependencies: true},
+			wantName:      "redis",
+			wantValues:    "port: 6379\n",
+			wantSubcharts: []string{"common"},
+		},
+		{
+			name: "subchart only",
+			archive: chartArchive(t, true,
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/charts/common/Chart.yaml", chartYaml("common", "0.1.0")},
+				tarEntry{"redis/charts/common/values.yaml", "common: true\n"}),
+			wantErr: "values.yaml not found in archive",
+		},
+		{
+			name: "repacked under a deeper root",
+			archive: chartArchive(t, true,
+				tarEntry{"build/out/redis/charts/common/Chart.yaml", chartYaml("common", "0.1.0")},
+				tarEntry{"build/out/redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"build/out/redis/values.yaml", "port: 6379\n"}),
+			wantName:   "redis",
+			wantValues: "port: 6379\n",
+		},
+		{
+			name: "files at the archive root",
+			archive: chartArchive(t, true,
+				tarEntry{"./Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"./values.yaml", "port: 6379\n"},
+				tarEntry{"./charts/common/Chart.yaml", chartYaml("common", "0.1.0")}),
+			wantName:   "redis",
+			wantValues: "port: 6379\n",
+		},
+		{
+			name: "entry outside the archive",
+			archive: chartArchive(t, true,
+				tarEntry{"../redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"../redis/values.yaml", "port: 6379\n"}),
+			wantErr: `has an entry "../redis/Chart.yaml" outside of the archive root`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.filename) == 0 {
+				tc.filename = "chart.tgz"
+			}
+			if len(tc.opts.valuesName) == 0 {
+				tc.opts.valuesName = defaultValuesName
+			}
+			filename := filepath.Join(t.TempDir(), tc.filename)
+			err := ioutil.WriteFile(filename, tc.archive, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values, err := getTarValues(filename, tc.opts)
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if values.Name != tc.wantName {
+				t.Errorf("got name %q, want %q", values.Name, tc.wantName)
+			}
+			if values.Values != tc.wantValues {
+				t.Errorf("got values %q, want %q", values.Values, tc.wantValues)
+			}
+			if !sameValue(values.Subcharts, tc.wantSubcharts) {
+				t.Errorf("got subcharts %q, want %q", values.Subcharts, tc.wantSubcharts)
+			}
+		})
+	}
+}
+
+func TestChartExtension(t *testing.T) {
+	for _, tc := range []struct {
+		filename    string
+		ext         string
+		placeholder string
+		tar         string
+	}{
+		{"redis-1.0.0.tgz", ".tgz", "redis-1.0.0", "redis-1.0.0.tar"},
+		{"redis-1.0.0.TGZ", ".TGZ", "redis-1.0.0", "redis-1.0.0.tar"},
+		{"dir/Redis.Tar.Gz", ".Tar.Gz", "Redis", "Redis.tar"},
+		{"redis.TAR", ".TAR", "redis", "redis.tar"},
+		{"redis.zip", "", "redis.zip", "redis.zip.tar"},
+	} {
+		if got := chartExtension(tc.filename); got != tc.ext {
+			t.Errorf("chartExtension(%q) = %q, want %q", tc.filename, got, tc.ext)
+		}
+		if got := hasChartExtension(tc.filename); got != (len(tc.ext) > 0) {
+			t.Errorf("hasChartExtension(%q) = %v", tc.filename, got)
+		}
+		if got := placeholderName(tc.filename); got != tc.placeholder {
+			t.Errorf("placeholderName(%q) = %q, want %q", tc.filename, got, tc.placeholder)
+		}
+		if got := recompressedName(tc.filename, false); got != tc.tar {
+			t.Errorf("recompressedName(%q, false) = %q, want %q", tc.filename, got, tc.tar)
+		}
+	}
+}
+
+// testValues returns the values of a small chart, filled in the way run
+// fills them in before rendering.
+func testValues() TarValues {
+	chart := Chart{
+		APIVersion:  "v1",
+		Name:        "redis",
+		Version:     "1.1.12",
+		Description: "Open source, advanced key-value store.",
+	}
+	return TarValues{
+		Name:        chart.Name,
+		Description: chart.Description,
+		TarfileName: "redis-1.1.12.tgz",
+		Values:      "port: 6379\n",
+		Chart:       chart,
+		BaseImage:   defaultBaseImage,
+		ChartDest:   "/opt/chart.tgz",
+	}
+}
+
+// testOptions returns the options that the command line defaults to, writing
+// into outputDir.
+func testOptions(outputDir string) options {
+	return options{
+		outputDir:           outputDir,
+		valuesName:          defaultValuesName,
+		maxFileSize:         defaultMaxFileSize,
+		maxDecompressedSize: defaultMaxDecompressedSize,
+		baseImage:           defaultBaseImage,
+		contextCompress:     true,
+		chartDest:           defaultChartDest,
+		descriptionSource:   descriptionSourceChart,
+		format:              formatYAML,
+		planName:            "default",
+		free:                true,
+		async:               "optional",
+	}
+}
+
+// readSpec reads the apb.yml that run wrote into dir.
+func readSpec(t *testing.T, dir string) *APB {
+	spec, err := readApbFile(filepath.Join(dir, apbYml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec == nil {
+		t.Fatalf("no %s in %s", apbYml, dir)
+	}
+	return spec
+}
+
+func TestWriteDockerfile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// change adjusts testValues for the case
+		change  func(v *TarValues)
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "default",
+			change:  func(v *TarValues) {},
+			want:    []string{"FROM " + defaultBaseImage + "\n", "\nCOPY redis-1.1.12.tgz /opt/chart.tgz\n"},
+			notWant: []string{"ARG CHART_TGZ", "WORKDIR", "--chown", "org.opencontainers"},
+		},
+		{
+			name:    "chart build arg",
+			change:  func(v *TarValues) { v.ChartBuildArg = true },
+			want:    []string{"\nARG CHART_TGZ\nCOPY ${CHART_TGZ} /opt/chart.tgz\n"},
+			notWant: []string{"COPY redis-1.1.12.tgz"},
+		},
+		{
+			name: "OCI labels",
+			change: func(v *TarValues) {
+				v.Provenance = &Provenance{Created: "2018-03-01T00:00:00Z", Version: "1.2.0", Source: `https://example.com/"redis"`}
+			},
+			want: []string{
+				`LABEL "org.opencontainers.image.created"="2018-03-01T00:00:00Z" \` + "\n",
+				`      "org.opencontainers.image.version"="1.2.0" \` + "\n",
+				`      "org.opencontainers.image.source"="https://example.com/\"redis\""` + "\n",
+			},
+		},
+		{
+			name:    "OCI labels without a time or source",
+			change:  func(v *TarValues) { v.Provenance = &Provenance{Version: "1.2.0"} },
+			want:    []string{`LABEL "org.opencontainers.image.version"="1.2.0"` + "\n"},
+			notWant: []string{"image.created", "image.source"},
+		},
+		{
+			name: "workdir and owner",
+			change: func(v *TarValues) {
+				v.Workdir = "/opt/apb"
+				v.ChartOwner = "1001:0"
+			},
+			want: []string{"\nWORKDIR /opt/apb\n\nCOPY --chown=1001:0 redis-1.1.12.tgz /opt/chart.tgz\n"},
+		},
+		{
+			name: "owner with a chart build arg",
+			change: func(v *TarValues) {
+				v.ChartOwner = "apb"
+				v.ChartBuildArg = true
+			},
+			want:    []string{"\nARG CHART_TGZ\nCOPY --chown=apb ${CHART_TGZ} /opt/chart.tgz\n"},
+			notWant: []string{"WORKDIR"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := testValues()
+			tc.change(&v)
+			var buf bytes.Buffer
+			err := writeDockerfile(&buf, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("Dockerfile does not contain %q:\n%s", want, buf.String())
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(buf.String(), notWant) {
+					t.Errorf("Dockerfile contains %q:\n%s", notWant, buf.String())
+				}
+			}
+		})
+	}
+}
+
+// writeLargeChart writes a chart whose values.yaml is size bytes long, and
+// whose templates come after it, to a new file in dir.
+func writeLargeChart(b *testing.B, dir string, size int64) string {
+	filename := filepath.Join(dir, "large-1.0.0.tgz")
+	f, err := os.Create(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tw := tar.NewWriter(gz)
+
+	write := func(name string, size int64, content io.Reader) {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = io.Copy(tw, content)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	chart := chartYaml("large", "1.0.0")
+	write("large/Chart.yaml", int64(len(chart)), strings.NewReader(chart))
+	line := "key: a value that is repeated to make values.yaml enormous\n"
+	write("large/values.yaml", size, io.LimitReader(repeatReader(line), size))
+	write("large/templates/deployment.yaml", size, io.LimitReader(repeatReader("# padding\n"), size))
+
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return filename
+}
+
+// repeatReader yields s over and over.
+type repeatReader string
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], r)
+	}
+	return n, nil
+}
+
+func BenchmarkGetTarValuesLargeValues(b *testing.B) {
+	if testing.Short() {
+		b.Skip("writes a multi-hundred-MB chart")
+	}
+	filename := writeLargeChart(b, b.TempDir(), 256<<20)
+	for _, bench := range []struct {
+		name string
+		opts readOptions
+	}{
+		{"values", readOptions{valuesName: defaultValuesName}},
+		{"skipValues", readOptions{valuesName: defaultValuesName, skipValues: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				values, err := getTarValues(filename, bench.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if values.Chart.Name != "large" {
+					b.Fatalf("got chart %q, want large", values.Chart.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteChartJSON(t *testing.T) {
+	chart, err := parseChart(strings.NewReader(`apiVersion: v1
+name: redis
+version: 1.1.12
+appVersion: 4.0.8
+kubeVersion: ">=1.8.0"
+description: Open source, advanced key-value store.
+icon: https://example.com/redis.png
+keywords:
+- redis
+- database
+maintainers:
+- name: bitnami-bot
+  email: containers@bitnami.com
+dependencies:
+- name: common
+  version: 0.1.0
+  repository: https://charts.example.com
+annotations:
+  category: Database
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = writeChartJSON(&buf, chart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+  "apiVersion": "v1",
+  "description": "Open source, advanced key-value store.",
+  "name": "redis",
+  "version": "1.1.12",
+  "appVersion": "4.0.8",
+  "kubeVersion": ">=1.8.0",
+  "icon": "https://example.com/redis.png",
+  "keywords": [
+    "redis",
+    "database"
+  ],
+  "maintainers": [
+    {
+      "name": "bitnami-bot",
+      "email": "containers@bitnami.com"
+    }
+  ],
+  "dependencies": [
+    {
+      "name": "common",
+      "version": "0.1.0",
+      "repository": "https://charts.example.com"
+    }
+  ],
+  "annotations": {
+    "category": "Database"
+  }
+}
+`
+	if buf.String() != want {
+		t.Errorf("got chart JSON:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestCheckHelmVersion(t *testing.T) {
+	for _, tc := range []struct {
+		apiVersion  string
+		helmVersion int
+		wantErr     string
+	}{
+		{"", 2, ""},
+		{"v1", 2, ""},
+		{"v2", 3, ""},
+		{"v1", 3, `apiVersion "v1" and requires Helm 2, but the base image uses Helm 3`},
+		{"v2", 2, `apiVersion "v2" and requires Helm 3, but the base image uses Helm 2`},
+		{"v3", 3, `unrecognized chart apiVersion "v3"`},
+	} {
+		err := checkHelmVersion(Chart{Name: "redis", APIVersion: tc.apiVersion}, tc.helmVersion)
+		if len(tc.wantErr) == 0 && err != nil {
+			t.Errorf("apiVersion %q with Helm %d: %v", tc.apiVersion, tc.helmVersion, err)
+		}
+		if len(tc.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("apiVersion %q with Helm %d: got error %v, want one containing %q", tc.apiVersion, tc.helmVersion, err, tc.wantErr)
+		}
+	}
+}
+
+func TestWriteBundleCR(t *testing.T) {
+	v := testValues()
+	var buf bytes.Buffer
+	err := writeBundleCR(&buf, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cr struct {
+		APIVersion string            `yaml:"apiVersion"`
+		Kind       string            `yaml:"kind"`
+		Metadata   map[string]string `yaml:"metadata"`
+		Spec       yaml.MapSlice     `yaml:"spec"`
+	}
+	err = yaml.Unmarshal(buf.Bytes(), &cr)
+	if err != nil {
+		t.Fatalf("custom resource is not yaml: %v\n%s", err, buf.String())
+	}
+	if cr.APIVersion != bundleCRAPIVersion || cr.Kind != bundleCRKind {
+		t.Errorf("got apiVersion %q and kind %q, want %q and %q", cr.APIVersion, cr.Kind, bundleCRAPIVersion, bundleCRKind)
+	}
+	if len(cr.Metadata) != 1 || cr.Metadata["name"] != "redis-apb" {
+		t.Errorf("got metadata %v, want only the name redis-apb", cr.Metadata)
+	}
+
+	// the spec is the same document as apb.yml
+	apb, err := renderApbYaml(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want yaml.MapSlice
+	err = yaml.Unmarshal(apb, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameValue(cr.Spec, want) {
+		t.Errorf("got custom resource:\n%s\nwant its spec to be:\n%s", buf.String(), apb)
+	}
+}
+
+func TestNormalizeValues(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values string
+		want   string
+	}{
+		{"empty", "", ""},
+		{
+			name:   "four spaces",
+			values: "image:\n    repository: redis\n    tag: 4.0.8\nports:\n    - 6379\n",
+			want:   "image:\n  repository: redis\n  tag: 4.0.8\nports:\n- 6379\n",
+		},
+		{
+			name:   "comments and key order",
+			values: "# the image\nserviceType: ClusterIP\nimage: redis  # pinned\nauth:\n      enabled: true\n",
+			want:   "serviceType: ClusterIP\nimage: redis\nauth:\n  enabled: true\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeValues(tc.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+
+	_, err := normalizeValues("image: [unterminated\n")
+	if err == nil {
+		t.Error("normalizeValues accepted invalid yaml")
+	}
+}
+
+func TestChartMappings(t *testing.T) {
+	v := testValues()
+	v.Values = "port: 6379\nauth: true\n"
+	parameters, err := expandParameters(v.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Parameters = parameters
+
+	got := make(map[string]fieldMapping)
+	for _, m := range chartMappings(v) {
+		got[m.Target] = m
+	}
+	for _, want := range []fieldMapping{
+		{"Chart.yaml name", "name", "redis-apb"},
+		{"Chart.yaml name", "metadata.displayName", "redis (helm bundle)"},
+		{"Chart.yaml description", "description", "Open source, advanced key-value store."},
+		{"Chart.yaml version", "metadata.chartVersion", "1.1.12"},
+		{"Chart.yaml name", "plans[default].description", "Deploys helm chart redis"},
+		{"values key port", "plans[default].parameters[port].default", "6379"},
+		{"values key auth", "plans[default].parameters[auth].default", "true"},
+		{"chart archive", "Dockerfile COPY", "redis-1.1.12.tgz"},
+	} {
+		if got[want.Target] != want {
+			t.Errorf("got mapping %+v for %s, want %+v", got[want.Target], want.Target, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = writeMappingReport(&buf, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "SOURCE") || !strings.Contains(buf.String(), "values key port") {
+		t.Errorf("mapping report is missing its header or a mapping:\n%s", buf.String())
+	}
+}
+
+func TestChartMappingsPlans(t *testing.T) {
+	v := testValues()
+	v.PlanDescription = "A cache"
+	v.Plans = []PlanValues{
+		{Name: "prod", File: "prod.yaml", Values: "port: 16380\n"},
+		{Name: "dev", File: "dev.yaml", Values: "port: 6380\n", Parameters: []Parameter{{Name: "port", Default: 6380}}},
+	}
+
+	got := make(map[string]fieldMapping)
+	for _, m := range chartMappings(v) {
+		got[m.Target] = m
+	}
+	for _, want := range []fieldMapping{
+		{"--plan-description", "plans[default].description", "A cache"},
+		{"values file", "plans[default].parameters[values].default", "11 bytes"},
+		{"Chart.yaml name, --plan prod", "plans[prod].description", "Deploys helm chart redis with prod values"},
+		{"--plan file prod.yaml", "plans[prod].parameters[values].default", "12 bytes"},
+		{"Chart.yaml name, --plan dev", "plans[dev].description", "Deploys helm chart redis with dev values"},
+		{"--plan file dev.yaml key port", "plans[dev].parameters[port].default", "6380"},
+	} {
+		if got[want.Target] != want {
+			t.Errorf("got mapping %+v for %s, want %+v", got[want.Target], want.Target, want)
+		}
+	}
+}
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestRunMappingReportEarlyReturns(t *testing.T) {
+	dir := t.TempDir()
+	chart := writeChart(t, dir, "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	for _, tc := range []struct {
+		name   string
+		change func(o *options)
+		// want is in the report, and notWant is not
+		want, notWant string
+	}{
+		{"dry run", func(o *options) { o.dryRun = true }, "Dockerfile COPY", ""},
+		{"custom resource", func(o *options) { o.emitCR = true }, "plans[default].description", "Dockerfile COPY"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := testOptions(filepath.Join(dir, "out"))
+			o.mappingReport = true
+			tc.change(&o)
+			var err error
+			out := captureStdout(t, func() { err = run(chart, o) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := out[strings.LastIndex(out, "SOURCE"):]
+			if !strings.Contains(out, "SOURCE") || !strings.Contains(report, tc.want) {
+				t.Errorf("no mapping report containing %q:\n%s", tc.want, out)
+			}
+			if len(tc.notWant) > 0 && strings.Contains(report, tc.notWant) {
+				t.Errorf("mapping report contains %q:\n%s", tc.notWant, report)
+			}
+		})
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	for _, tc := range []struct {
+		epoch   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"1519862400", "2018-03-01T00:00:00Z", false},
+		{"yesterday", "", true},
+	} {
+		t.Setenv(sourceDateEpochEnv, tc.epoch)
+		got, err := sourceDateEpoch()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s=%q: got error %v", sourceDateEpochEnv, tc.epoch, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s=%q: got %q, want %q", sourceDateEpochEnv, tc.epoch, got, tc.want)
+		}
+	}
+}
+
+func TestPlanDescription(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		o    options
+		// bindable marks the bundle as bindable
+		bindable bool
+		want     string
+	}{
+		{"generated", options{}, false, "Deploys helm chart redis"},
+		{"generated bindable", options{}, true, "Deploys helm chart redis; supports binding"},
+		{"from chart", options{planDescriptionFromChart: true}, false, "Open source, advanced key-value store."},
+		{"flag", options{planDescription: "A cache"}, false, "A cache"},
+		{"flag over chart", options{planDescription: "A cache", planDescriptionFromChart: true}, true, "A cache"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := testValues()
+			v.Bindable = tc.bindable
+			v.PlanDescription = tc.o.defaultPlanDescription(v.Description)
+			got := NewAPB(v).Plans[0].Description
+			if got != tc.want {
+				t.Errorf("got plan description %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCatalogTags(t *testing.T) {
+	chart := Chart{
+		Keywords:    []string{"redis", "keyvalue", "redis", ""},
+		Annotations: map[string]string{"tags": "database, redis ,cache,,keyvalue"},
+	}
+	for _, tc := range []struct {
+		annotation string
+		want       []string
+	}{
+		{"", []string{"redis", "keyvalue"}},
+		{"tags", []string{"redis", "keyvalue", "database", "cache"}},
+		{"missing", []string{"redis", "keyvalue"}},
+	} {
+		got := catalogTags(chart, tc.annotation)
+		if !sameValue(got, tc.want) {
+			t.Errorf("annotation %q: got tags %q, want %q", tc.annotation, got, tc.want)
+		}
+	}
+
+	if got := catalogTags(Chart{}, "tags"); got != nil {
+		t.Errorf("got tags %q for a chart with none, want nil", got)
+	}
+}
+
+func TestRenderOmitEmpty(t *testing.T) {
+	// an empty values file, a plan without metadata and a chart without an
+	// icon or maintainers leave plenty to omit
+	v := testValues()
+	v.Values = ""
+	v.OmitEmpty = true
+
+	data, err := renderApbYaml(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "omit-empty.apb.yml", data)
+
+	data, err = renderApbJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "omit-empty.apb.json", data)
+}
+
+func TestValidateChart(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		chart   string
+		values  string
+		schema  string
+		change  func(o *options)
+		wantErr string
+	}{
+		{"valid", chartYaml("redis", "1.0.0"), "port: 6379\n", "", nil, ""},
+		{"unrecognized apiVersion", strings.Replace(chartYaml("redis", "1.0.0"), "v1", "v3", 1), "port: 6379\n", "", nil, `apiVersion "v3"`},
+		{"allowed apiVersion", strings.Replace(chartYaml("redis", "1.0.0"), "v1", "v3", 1), "port: 6379\n", "", func(o *options) { o.allowAPIVersions = []string{"v3"} }, ""},
+		{"invalid values", chartYaml("redis", "1.0.0"), "port: [6379\n", "", nil, "values.yaml"},
+		{"binary values", chartYaml("redis", "1.0.0"), "port: 6379\x00\n", "", nil, "use --force"},
+		{"forced binary values", chartYaml("redis", "1.0.0"), "port: 6379\x00\n", "", func(o *options) { o.force = true }, ""},
+		{"invalid schema", chartYaml("redis", "1.0.0"), "port: 6379\n", "{", nil, "could not generate parameters"},
+		{"expanded scalar values", chartYaml("redis", "1.0.0"), "just a string\n", "", func(o *options) { o.expandParams = true }, "could not generate parameters"},
+		{"invalid flags", chartYaml("redis", "1.0.0"), "port: 6379\n", "", func(o *options) { o.async = "sometimes" }, "invalid --async"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := []tarEntry{{"redis/Chart.yaml", tc.chart}, {"redis/values.yaml", tc.values}}
+			if len(tc.schema) > 0 {
+				entries = append(entries, tarEntry{"redis/values.schema.json", tc.schema})
+			}
+			filename := writeChart(t, t.TempDir(), "redis-1.0.0.tgz", entries...)
+			o := testOptions("")
+			if tc.change != nil {
+				tc.change(&o)
+			}
+			var buf bytes.Buffer
+			err := validateChart(&buf, filename, o)
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(buf.String(), "name:") || !strings.Contains(buf.String(), "redis") {
+				t.Errorf("summary does not name the chart:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestExtractChartFiles(t *testing.T) {
+	// comments and odd indentation must survive extraction
+	chart := "# the chart\napiVersion: v1\nname:   redis\nversion: 1.0.0\n"
+	values := "# defaults\nimage:\n    tag: 4.0.8   # pinned\n"
+	filename := writeChart(t, t.TempDir(), "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chart},
+		tarEntry{"redis/values-prod.yaml", values})
+	v, err := getTarValues(filename, readOptions{valuesName: "values-prod.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "out")
+	err = extractChartFiles(v, dir, "values-prod.yaml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"Chart.yaml": chart, "values-prod.yaml": values} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got %s:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+
+	err = extractChartFiles(v, dir, "values-prod.yaml", false)
+	if err == nil || !strings.Contains(err.Error(), "use --force to overwrite") {
+		t.Errorf("got error %v extracting over existing files without force", err)
+	}
+	err = extractChartFiles(v, dir, "values-prod.yaml", true)
+	if err != nil {
+		t.Errorf("extracting over existing files with force: %v", err)
+	}
+}
+
+func TestReadmeDescription(t *testing.T) {
+	for _, tc := range []struct {
+		readme string
+		want   string
+	}{
+		{"", ""},
+		{"# Redis\n\n[Redis](http://redis.io) is a key-value store.\n\n## Usage\n", "[Redis](http://redis.io) is a key-value store."},
+		{"Redis\n=====\n\n  An in-memory cache.  \n", "An in-memory cache."},
+		{"Redis\n-----\nAn in-memory cache.\n", "An in-memory cache."},
+		{"# Redis\n## TL;DR\n", ""},
+	} {
+		if got := readmeDescription(tc.readme); got != tc.want {
+			t.Errorf("readmeDescription(%q) = %q, want %q", tc.readme, got, tc.want)
+		}
+	}
+}
+
+func TestRunDescriptionFromReadme(t *testing.T) {
+	dir := t.TempDir()
+	withReadme := writeChart(t, dir, "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		tarEntry{"redis/README.md", "# Redis\n\nAn in-memory data store.\n"},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	withoutReadme := writeChart(t, dir, "mariadb-1.0.0.tgz",
+		tarEntry{"mariadb/Chart.yaml", chartYaml("mariadb", "1.0.0")},
+		tarEntry{"mariadb/values.yaml", "port: 3306\n"})
+
+	for _, tc := range []struct {
+		filename string
+		want     string
+	}{
+		{withReadme, "An in-memory data store."},
+		{withoutReadme, "A test chart"},
+	} {
+		o := testOptions(filepath.Join(dir, filepath.Base(tc.filename)+".out"))
+		o.descriptionSource = descriptionSourceReadme
+		err := run(tc.filename, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readSpec(t, o.outputDir).Description; got != tc.want {
+			t.Errorf("%s: got description %q, want %q", tc.filename, got, tc.want)
+		}
+	}
+}
+
+func TestRunBinaryValues(t *testing.T) {
+	binary := "port: 6379\n\x00\xff\xfe"
+	for _, tc := range []struct {
+		name   string
+		values string
+		force  bool
+		// change adjusts the options, and schema is the chart's
+		// values.schema.json, if it has one
+		change  func(o *options)
+		schema  string
+		wantErr string
+		// want is the values parameter default expected when there is no
+		// error
+		want string
+	}{
+		{"text", "port: 6379\n", false, nil, "", "", "port: 6379\n"},
+		{"invalid UTF-8", "port: \xff\n", false, nil, "", "values.yaml contains binary data; use --force", ""},
+		{"NUL byte", "port: 6379\x00\n", false, nil, "", "values.yaml contains binary data; use --force", ""},
+		{"forced", binary, true, nil, "", "", base64.StdEncoding.EncodeToString([]byte(binary))},
+		{"forced with schema", binary, true, nil, testSchema, "", base64.StdEncoding.EncodeToString([]byte(binary))},
+		{"forced expanded", binary, true, func(o *options) { o.expandParams = true }, "", "", base64.StdEncoding.EncodeToString([]byte(binary))},
+		{"forced normalized", binary, true, func(o *options) { o.normalizeValues = true }, "", "--merge-values and --normalize-values cannot be used", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entries := []tarEntry{
+				{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				{"redis/values.yaml", tc.values},
+			}
+			if len(tc.schema) > 0 {
+				entries = append(entries, tarEntry{"redis/values.schema.json", tc.schema})
+			}
+			filename := writeChart(t, dir, "redis-1.0.0.tgz", entries...)
+			o := testOptions(filepath.Join(dir, "out"))
+			o.force = tc.force
+			if tc.change != nil {
+				tc.change(&o)
+			}
+			err := run(filename, o)
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			parameters := readSpec(t, o.outputDir).Plans[0].Parameters
+			if len(parameters) != 1 || parameters[0].Name != "values" {
+				t.Fatalf("got parameters %+v, want the single values parameter", parameters)
+			}
+			if got := parameters[0].Default; got != tc.want {
+				t.Errorf("got values default %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunNameFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeChart(t, dir, "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	o := testOptions(filepath.Join(dir, "out"))
+	o.nameFiles = true
+	o.withBuildScript = true
+	err := run(filename, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := ioutil.ReadDir(o.outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	want := []string{"redis-1.0.0.tgz", "redis-apb.Dockerfile", "redis-apb.apb.yml", "redis-apb.build.sh"}
+	if !sameValue(names, want) {
+		t.Errorf("got files %q, want %q", names, want)
+	}
+	script, err := ioutil.ReadFile(filepath.Join(o.outputDir, "redis-apb.build.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(script), "-f 'redis-apb.Dockerfile'") {
+		t.Errorf("build script does not use the named Dockerfile:\n%s", script)
+	}
+
+	// a JSON spec is named the same way
+	v := testValues()
+	v.Format = formatJSON
+	spec, dockerFile, buildFile := outputNames(v, true)
+	if spec != "redis-apb.apb.json" || dockerFile != "redis-apb.Dockerfile" || buildFile != "redis-apb.build.sh" {
+		t.Errorf("got names %s, %s and %s for a JSON spec", spec, dockerFile, buildFile)
+	}
+}
+
+func TestNewAPB(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		chartYaml string
+		// change adjusts the values read from chartYaml
+		change       func(v *TarValues)
+		wantName     string
+		wantMetadata map[string]interface{}
+		wantPlans    []string
+	}{
+		{
+			name:      "chart",
+			chartYaml: "apiVersion: v1\nname: redis\nversion: 1.1.12\nappVersion: 4.0.8\n",
+			change:    func(v *TarValues) {},
+			wantName:  "redis-apb",
+			wantMetadata: map[string]interface{}{
+				"displayName":                    "redis (helm bundle)",
+				"console.openshift.io/iconClass": "icon-redis",
+				"chartApiVersion":                "v1",
+				"chartVersion":                   "1.1.12",
+				"appVersion":                     "4.0.8",
+			},
+			wantPlans: []string{"default"},
+		},
+		{
+			name:      "kubeVersion",
+			chartYaml: "name: redis\nkubeVersion: \">=1.10.0 <1.20.0\"\n",
+			change:    func(v *TarValues) {},
+			wantName:  "redis-apb",
+			wantMetadata: map[string]interface{}{
+				"displayName":                    "redis (helm bundle)",
+				"console.openshift.io/iconClass": "icon-redis",
+				"kubeVersion":                    ">=1.10.0 <1.20.0",
+			},
+			wantPlans: []string{"default"},
+		},
+		{
+			name:      "bundle name and plans",
+			chartYaml: "name: redis\n",
+			change: func(v *TarValues) {
+				v.BundleName = "cache"
+				v.PlanName = "small"
+				v.Plans = []PlanValues{{Name: "large", Values: "replicas: 3\n"}}
+			},
+			wantName: "cache-apb",
+			wantMetadata: map[string]interface{}{
+				"displayName":                    "cache (helm bundle)",
+				"console.openshift.io/iconClass": "icon-redis",
+			},
+			wantPlans: []string{"small", "large"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chart, err := parseChart(strings.NewReader(tc.chartYaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := TarValues{Name: chart.Name, Values: "port: 6379\n", Chart: chart}
+			tc.change(&v)
+
+			apb := NewAPB(v)
+			if apb.Version != "1.0" || apb.Name != tc.wantName {
+				t.Errorf("got version %q and name %q, want 1.0 and %q", apb.Version, apb.Name, tc.wantName)
+			}
+			if !sameValue(apb.Metadata, tc.wantMetadata) {
+				t.Errorf("got metadata %v, want %v", apb.Metadata, tc.wantMetadata)
+			}
+			var plans []string
+			for _, plan := range apb.Plans {
+				plans = append(plans, plan.Name)
+			}
+			if !sameValue(plans, tc.wantPlans) {
+				t.Errorf("got plans %q, want %q", plans, tc.wantPlans)
+			}
+
+			// the rendered document reads back as the same spec
+			data, err := renderApbYaml(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rendered APB
+			err = yaml.Unmarshal(data, &rendered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameValue(&rendered, apb) {
+				t.Errorf("rendered spec reads back differently:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestRunOverwriteConfirmation(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		force          bool
+		requireConfirm bool
+		confirm        string
+		wantErr        string
+	}{
+		{"no force", false, false, "", "use --force to overwrite"},
+		{"force", true, false, "", ""},
+		{"confirmation required but missing", true, true, "", "set " + overwriteConfirmEnv + "=yes to let --force overwrite"},
+		{"confirmation required but not yes", true, true, "y", "set " + overwriteConfirmEnv + "=yes to let --force overwrite"},
+		{"confirmed", true, true, "yes", ""},
+		{"confirmed without force", false, true, "yes", "use --force to overwrite"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := writeChart(t, dir, "redis-1.0.0.tgz",
+				tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+				tarEntry{"redis/values.yaml", "port: 6379\n"})
+			o := testOptions(filepath.Join(dir, "out"))
+			err := run(filename, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			apbFile := filepath.Join(o.outputDir, apbYml)
+			err = ioutil.WriteFile(apbFile, []byte("edited by hand\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Setenv(overwriteConfirmEnv, tc.confirm)
+			o.force = tc.force
+			o.requireConfirm = tc.requireConfirm
+			err = run(filename, o)
+			data, readErr := ioutil.ReadFile(apbFile)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				if string(data) != "edited by hand\n" {
+					t.Errorf("%s was overwritten", apbYml)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) == "edited by hand\n" {
+				t.Errorf("%s was not overwritten", apbYml)
+			}
+		})
+	}
+}
+
+func TestPhaseTimer(t *testing.T) {
+	timer := newPhaseTimer("redis-1.0.0.tgz")
+	for _, name := range []string{"parse", "render", "write"} {
+		time.Sleep(time.Millisecond)
+		timer.mark(name)
+	}
+
+	var total time.Duration
+	for i, phase := range timer.phases {
+		if phase.duration < time.Millisecond {
+			t.Errorf("phase %s took %s, less than the time slept in it", phase.name, phase.duration)
+		}
+		if i > 0 && phase.name == timer.phases[i-1].name {
+			t.Errorf("phase %s recorded twice", phase.name)
+		}
+		total += phase.duration
+	}
+	// each phase starts where the last one ended
+	if elapsed := timer.last.Sub(timer.start); total != elapsed {
+		t.Errorf("phases add up to %s, but %s elapsed", total, elapsed)
+	}
+}
+
+func TestPhaseTimerAdd(t *testing.T) {
+	batch := newPhaseTimer("2 charts")
+	first := &phaseTimer{phases: []phaseTiming{{"parse", time.Second}, {"write", 2 * time.Second}}}
+	second := &phaseTimer{phases: []phaseTiming{{"fetch", time.Second}, {"parse", 3 * time.Second}}}
+	batch.add(first)
+	batch.add(second)
+
+	want := []phaseTiming{{"parse", 4 * time.Second}, {"write", 2 * time.Second}, {"fetch", time.Second}}
+	if len(batch.phases) != len(want) {
+		t.Fatalf("got phases %v, want %v", batch.phases, want)
+	}
+	for i := range want {
+		if batch.phases[i] != want[i] {
+			t.Errorf("got phase %v, want %v", batch.phases[i], want[i])
+		}
+	}
+	if !batch.last.After(batch.start) {
+		t.Error("adding a chart's phases did not extend the batch total")
+	}
+}
+
+func TestRunTimings(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeChart(t, dir, "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	for _, tc := range []struct {
+		name   string
+		change func(o *options)
+		want   []string
+	}{
+		{"write", func(o *options) {}, []string{"parse", "prepare", "context", "render", "write"}},
+		{"dry run", func(o *options) { o.dryRun = true }, []string{"parse", "prepare", "context", "render"}},
+		{"custom resource", func(o *options) { o.emitCR = true }, []string{"parse", "prepare"}},
+		{"chart JSON", func(o *options) { o.emitChartJSON = true }, []string{"parse", "prepare"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := testOptions(filepath.Join(dir, "out-"+strings.Replace(tc.name, " ", "-", -1)))
+			o.timings = true
+			tc.change(&o)
+
+			var buf bytes.Buffer
+			saved := *logger
+			logger.out = &buf
+			defer func() { *logger = saved }()
+			var err error
+			captureStdout(t, func() { err = run(filename, o) })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// every line names the chart
+			prefix := "timing: " + filename + ": "
+			var phases []string
+			var sum, total time.Duration
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if !strings.HasPrefix(line, prefix) {
+					t.Errorf("timing line %q does not start with %q", line, prefix)
+					continue
+				}
+				var name, duration string
+				line = strings.TrimPrefix(line, prefix)
+				if _, err := fmt.Sscanf(line, "%s took %s", &name, &duration); err == nil {
+					d, err := time.ParseDuration(duration)
+					if err != nil {
+						t.Fatalf("%q: %v", line, err)
+					}
+					phases = append(phases, name)
+					sum += d
+				} else if _, err := fmt.Sscanf(line, "total %s", &duration); err == nil {
+					total, err = time.ParseDuration(duration)
+					if err != nil {
+						t.Fatalf("%q: %v", line, err)
+					}
+				}
+			}
+			if !sameValue(phases, tc.want) {
+				t.Errorf("got phases %q, want %q:\n%s", phases, tc.want, buf.String())
+			}
+			if total <= 0 || sum != total {
+				t.Errorf("phases add up to %s, but the total is %s", sum, total)
+			}
+		})
+	}
+}
+
+func TestRunBatchTimings(t *testing.T) {
+	dir := t.TempDir()
+	o := testOptions(filepath.Join(dir, "out"))
+	o.batchDirs = make(map[string]string)
+	o.batchTimer = newPhaseTimer("2 charts")
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		filename := writeChart(t, dir, "redis-"+version+".tgz",
+			tarEntry{"redis/Chart.yaml", chartYaml("redis", version)},
+			tarEntry{"redis/values.yaml", "port: 6379\n"})
+		err := run(filename, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, phase := range o.batchTimer.phases {
+		names = append(names, phase.name)
+	}
+	if want := []string{"parse", "prepare", "context", "render", "write"}; !sameValue(names, want) {
+		t.Errorf("got batch phases %q, want %q", names, want)
+	}
+	var sum time.Duration
+	for _, phase := range o.batchTimer.phases {
+		sum += phase.duration
+	}
+	if elapsed := o.batchTimer.last.Sub(o.batchTimer.start); sum > elapsed {
+		t.Errorf("batch phases add up to %s, more than the %s that elapsed", sum, elapsed)
+	}
+}
+
+func TestChartOwnerPattern(t *testing.T) {
+	for owner, valid := range map[string]bool{
+		"1001":       true,
+		"1001:0":     true,
+		"apb":        true,
+		"apb:root":   true,
+		"apb_1:wh-1": true,
+		"":           false,
+		"1001:":      false,
+		":0":         false,
+		"Apb":        false,
+		"apb:0:0":    false,
+		"apb root":   false,
+	} {
+		if got := chartOwnerPattern.MatchString(owner); got != valid {
+			t.Errorf("chartOwnerPattern matches %q: %v, want %v", owner, got, valid)
+		}
+	}
+}
+
+func TestMergeValuesFiles(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i, content := range []string{
+		// replaces a scalar, merges a map and adds a key
+		"image:\n  tag: 5.0.0\nreplicas: 2\n",
+		// a later file wins over an earlier one, and null removes a key
+		"image:\n  pullPolicy: Always\nreplicas: 3\npersistence: null\n",
+		// lists are replaced, not appended to
+		"ports:\n- 6380\n",
+	} {
+		filename := filepath.Join(dir, fmt.Sprintf("values-%d.yaml", i))
+		err := ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filename)
+	}
+
+	base := "image:\n  repository: redis\n  tag: 4.0.8\n  pullPolicy: IfNotPresent\nports:\n- 6379\npersistence:\n  enabled: true\n"
+	got, err := mergeValuesFiles(base, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "image:\n  repository: redis\n  tag: 5.0.0\n  pullPolicy: Always\nports:\n- 6380\nreplicas: 3\n"
+	if got != want {
+		t.Errorf("got merged values:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, err = mergeValuesFiles(base, []string{filepath.Join(dir, "missing.yaml")})
+	if err == nil {
+		t.Error("merging a missing file did not fail")
+	}
+}
+
+func TestSizeLimitedReader(t *testing.T) {
+	for _, tc := range []struct {
+		size    int
+		limit   int64
+		wantErr bool
+	}{
+		{1024, 2048, false},
+		{1024, 1024, false},
+		{1025, 1024, true},
+		{0, 0, false},
+	} {
+		r := &sizeLimitedReader{r: strings.NewReader(strings.Repeat("x", tc.size)), remaining: tc.limit, limit: tc.limit}
+		data, err := ioutil.ReadAll(r)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("reading %d bytes with a limit of %d: got error %v", tc.size, tc.limit, err)
+		}
+		if err == nil && len(data) != tc.size {
+			t.Errorf("reading %d bytes with a limit of %d: got %d bytes", tc.size, tc.limit, len(data))
+		}
+	}
+}
+
+func TestRunBatchOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	redis := writeChart(t, dir, "redis-1.1.12.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.1.12")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	mariadb := writeChart(t, dir, "mariadb-2.1.6.tgz",
+		tarEntry{"mariadb/Chart.yaml", chartYaml("mariadb", "2.1.6")},
+		tarEntry{"mariadb/values.yaml", "port: 3306\n"})
+
+	for _, tc := range []struct {
+		name      string
+		outputDir string
+		want      []string
+	}{
+		{"plain", "bundles", []string{"bundles/mariadb-2.1.6", "bundles/redis-1.1.12"}},
+		{"template", "bundles/{{.Name}}/v{{.Version}}", []string{"bundles/mariadb/v2.1.6", "bundles/redis/v1.1.12"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			o := testOptions(filepath.Join(root, tc.outputDir))
+			o.batchDirs = make(map[string]string)
+			for _, filename := range []string{redis, mariadb} {
+				err := run(filename, o)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Name() == apbYml {
+					rel, err := filepath.Rel(root, filepath.Dir(path))
+					got = append(got, filepath.ToSlash(rel))
+					return err
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameValue(got, tc.want) {
+				t.Errorf("got bundles in %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// a template that does not tell the charts apart is an error
+	o := testOptions(filepath.Join(t.TempDir(), "{{.APIVersion}}"))
+	o.batchDirs = make(map[string]string)
+	err := run(redis, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run(mariadb, o)
+	if err == nil || !strings.Contains(err.Error(), "use an --output-dir template that tells them apart") {
+		t.Errorf("got error %v for two charts in one directory", err)
+	}
+
+	_, err = expandOutputDir("bundles/{{.Name", Chart{})
+	if err == nil || !strings.Contains(err.Error(), "invalid --output-dir template") {
+		t.Errorf("got error %v for an invalid template", err)
+	}
+}
+
+// testSchema is a values.schema.json that requires two of its properties and
+// constrains them.
+const testSchema = `{
+  "type": "object",
+  "required": ["password", "serviceType"],
+  "properties": {
+    "port": {"type": "integer", "description": "Port to listen on"},
+    "password": {"type": "string", "pattern": "^.{8,}$"},
+    "serviceType": {"type": "string", "enum": ["ClusterIP", "NodePort"]}
+  }
+}`
+
+func TestValuesParametersRequired(t *testing.T) {
+	values := "port: 6379\npassword: \"\"\nserviceType: ClusterIP\nauth: true\n"
+	for _, tc := range []struct {
+		name   string
+		expand bool
+		// want maps each parameter to whether it is required
+		want map[string]bool
+	}{
+		{"expanded", true, map[string]bool{"port": false, "password": true, "serviceType": true, "auth": false}},
+		{"from schema", false, map[string]bool{"port": false, "password": true, "serviceType": true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parameters, err := valuesParameters(values, testSchema, tc.expand)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]bool)
+			for _, p := range parameters {
+				got[p.Name] = p.Required
+				switch p.Name {
+				case "password":
+					if p.Pattern != "^.{8,}$" {
+						t.Errorf("got pattern %q for password", p.Pattern)
+					}
+				case "serviceType":
+					if !sameValue(p.Enum, []interface{}{"ClusterIP", "NodePort"}) {
+						t.Errorf("got enum %v for serviceType", p.Enum)
+					}
+				}
+			}
+			if !sameValue(got, tc.want) {
+				t.Errorf("got required %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	// without a schema or expansion the plan keeps its single parameter,
+	// which is always required
+	parameters, err := valuesParameters(values, "", false)
+	if err != nil || parameters != nil {
+		t.Errorf("got parameters %v and error %v without a schema", parameters, err)
+	}
+	_, err = valuesParameters(values, "{not json", true)
+	if err == nil {
+		t.Error("an invalid schema was accepted")
+	}
+}
+
+func TestContextChart(t *testing.T) {
+	entries := []tarEntry{
+		{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		{"redis/values.yaml", "port: 6379\n"},
+	}
+	for _, tc := range []struct {
+		name string
+		// source is "tgz", "tar" or "dir"
+		source string
+		// inside puts the chart in the build context already
+		inside   bool
+		compress bool
+		want     string
+	}{
+		{"tgz", "tgz", false, true, "redis-1.0.0.tgz"},
+		{"tgz uncompressed", "tgz", false, false, "redis-1.0.0.tar"},
+		{"tar compressed", "tar", false, true, "redis-1.0.0.tgz"},
+		{"tar", "tar", false, false, "redis-1.0.0.tar"},
+		{"tgz in place", "tgz", true, true, "redis-1.0.0.tgz"},
+		{"tgz in place uncompressed", "tgz", true, false, "redis-1.0.0.tar"},
+		{"directory", "dir", false, true, "redis-1.0.0.tgz"},
+		{"directory uncompressed", "dir", false, false, "redis-1.0.0.tar"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			dir := filepath.Join(src, "context")
+			if tc.inside {
+				dir = src
+			}
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var filename string
+			switch tc.source {
+			case "dir":
+				filename = filepath.Join(src, "redis")
+				for _, e := range entries {
+					path := filepath.Join(src, filepath.FromSlash(e.name))
+					err := os.MkdirAll(filepath.Dir(path), 0755)
+					if err == nil {
+						err = ioutil.WriteFile(path, []byte(e.content), 0644)
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			default:
+				filename = filepath.Join(src, "redis-1.0.0."+tc.source)
+				err := ioutil.WriteFile(filename, chartArchive(t, tc.source == "tgz", entries...), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			v, err := getChartValues(filename, readOptions{valuesName: defaultValuesName})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a dry run only names the file
+			name, err := contextChart(filename, v, dir, tc.compress, false, true, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tc.want {
+				t.Errorf("dry run: got %s, want %s", name, tc.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != (tc.inside && tc.compress) {
+				t.Errorf("dry run: got error %v looking for %s", err, name)
+			}
+
+			name, err = contextChart(filename, v, dir, tc.compress, false, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tc.want {
+				t.Errorf("got %s, want %s", name, tc.want)
+			}
+			target := filepath.Join(dir, name)
+			gzipped, err := isGzipped(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gzipped != tc.compress {
+				t.Errorf("%s is gzipped: %v, want %v", name, gzipped, tc.compress)
+			}
+			copied, err := getTarValues(target, readOptions{valuesName: defaultValuesName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied.Name != "redis" || copied.Values != "port: 6379\n" {
+				t.Errorf("%s holds chart %q with values %q", name, copied.Name, copied.Values)
+			}
+			leftovers, err := filepath.Glob(filepath.Join(dir, ".*.tmp*"))
+			if err != nil || len(leftovers) > 0 {
+				t.Errorf("temporary files left behind: %v %v", leftovers, err)
+			}
+
+			if tc.inside && tc.compress {
+				return
+			}
+			_, err = contextChart(filename, v, dir, tc.compress, false, false, false)
+			if err == nil || !strings.Contains(err.Error(), "use --force to overwrite existing") {
+				t.Errorf("got error %v writing over %s without overwrite", err, name)
+			}
+			_, err = contextChart(filename, v, dir, tc.compress, true, false, false)
+			if err != nil {
+				t.Errorf("writing over %s with overwrite: %v", name, err)
+			}
+		})
+	}
+}
+
+func TestSchemaParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		schema string
+		values string
+		want   []Parameter
+	}{
+		{
+			name:   "typed",
+			schema: testSchema,
+			values: "port: 6379\npassword: secret123\n",
+			want: []Parameter{
+				{Name: "port", Title: "Port to listen on", Type: "int", Default: 6379},
+				{Name: "password", Title: "Password", Type: "string", Default: "secret123", Pattern: "^.{8,}$", Required: true},
+				{Name: "serviceType", Title: "Service Type", Type: "string", Default: "", Enum: []interface{}{"ClusterIP", "NodePort"}, Required: true},
+			},
+		},
+		{
+			name: "nested and nullable",
+			schema: `{"properties": {
+				"image": {"type": "object"},
+				"ports": {"type": "array", "default": [6379]},
+				"replicas": {"type": ["null", "integer"]},
+				"debug": {}
+			}}`,
+			values: "image:\n  tag: 4.0.8\ndebug: true\n",
+			want: []Parameter{
+				{Name: "image", Title: "Image", Type: "string", DisplayType: "textarea", Default: "tag: 4.0.8\n"},
+				{Name: "debug", Title: "Debug", Type: "boolean", Default: true},
+				{Name: "ports", Title: "Ports", Type: "string", DisplayType: "textarea", Default: "- 6379\n"},
+				{Name: "replicas", Title: "Replicas", Type: "int", Default: 0},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := schemaParameters(tc.schema, tc.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameValue(got, tc.want) {
+				gotYaml, _ := yaml.Marshal(got)
+				wantYaml, _ := yaml.Marshal(tc.want)
+				t.Errorf("got parameters:\n%s\nwant:\n%s", gotYaml, wantYaml)
+			}
+		})
+	}
+
+	_, err := schemaParameters("{not json", "")
+	if err == nil {
+		t.Error("an invalid schema was accepted")
+	}
+}
+
+func TestRenderApbYamlRequired(t *testing.T) {
+	v := testValues()
+	data, err := renderApbYaml(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "  parameters:\n  - name: values\n    title: Values\n    type: string\n    display_type: textarea\n    default: |\n      port: 6379\n    required: true\n"
+	if !strings.Contains(string(data), want) {
+		t.Errorf("the values parameter is not marked required:\n%s", data)
+	}
+
+	// only expanded parameters that the schema requires are marked, and
+	// their constraints are kept
+	v.Values = "port: 6379\npassword: secret123\n"
+	v.Parameters, err = valuesParameters(v.Values, testSchema, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = renderApbYaml(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"  - name: port\n    title: Port\n    type: int\n    default: 6379\n  - name",
+		"  - name: password\n    title: Password\n    type: string\n    default: secret123\n    pattern: ^.{8,}$\n    required: true\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("apb.yml does not contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestMergeAPB(t *testing.T) {
+	// existing is what was generated for an older chart, as read back from
+	// disk, and then edited by hand
+	old := testValues()
+	old.Chart.Version = "1.0.0"
+	old.Chart.Icon = "https://example.com/old.png"
+	old.Values = "port: 6379\nauth: true\n"
+	var err error
+	old.Parameters, err = expandParameters(old.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBack := func(v TarValues) *APB {
+		data, err := renderApbYaml(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), apbYml)
+		err = ioutil.WriteFile(filename, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec, err := readApbFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spec
+	}
+
+	newer := testValues()
+	newer.Values = "port: 6380\nauth: true\nreplicas: 2\n"
+	newer.Parameters, err = expandParameters(newer.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// generated is the chart the spec is merged with
+		generated TarValues
+		// wantWarnings is whether replacing chart fields should be
+		// reported as discarding hand edits
+		wantWarnings bool
+	}{
+		{"new chart version", newer, false},
+		{"same chart version", func() TarValues { v := newer; v.Chart.Version = "1.0.0"; return v }(), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			existing := readBack(old)
+			existing.Bindable = true
+			existing.Description = "A description edited by hand"
+			existing.Metadata["documentationUrl"] = "https://example.com/docs"
+			existing.Plans = append(existing.Plans, Plan{Name: "extra", Description: "Added by hand"})
+
+			var buf bytes.Buffer
+			saved := *logger
+			logger.out = &buf
+			defer func() { *logger = saved }()
+			merged := mergeAPB(existing, NewAPB(tc.generated))
+
+			if merged.Description != tc.generated.Description {
+				t.Errorf("got description %q, want the chart's", merged.Description)
+			}
+			if !merged.Bindable {
+				t.Error("bindable was not kept")
+			}
+			wantMetadata := map[string]interface{}{
+				"displayName":                    "redis (helm bundle)",
+				"console.openshift.io/iconClass": "icon-redis",
+				"chartApiVersion":                "v1",
+				"chartVersion":                   tc.generated.Chart.Version,
+				"documentationUrl":               "https://example.com/docs",
+			}
+			if !sameValue(merged.Metadata, wantMetadata) {
+				t.Errorf("got metadata %v, want %v", merged.Metadata, wantMetadata)
+			}
+
+			var plans []string
+			for _, plan := range merged.Plans {
+				plans = append(plans, plan.Name)
+			}
+			if !sameValue(plans, []string{"default", "extra"}) {
+				t.Errorf("got plans %q, want default and extra", plans)
+			}
+			defaults := make(map[string]interface{})
+			for _, p := range merged.Plans[0].Parameters {
+				defaults[p.Name] = p.Default
+			}
+			if !sameValue(defaults, map[string]interface{}{"port": 6380, "auth": true, "replicas": 2}) {
+				t.Errorf("got parameter defaults %v", defaults)
+			}
+
+			warned := strings.Contains(buf.String(), "which was changed by hand")
+			if warned != tc.wantWarnings {
+				t.Errorf("got warnings %v, want %v:\n%s", warned, tc.wantWarnings, buf.String())
+			}
+			if !strings.Contains(buf.String(), "adding parameter replicas to plan default") {
+				t.Errorf("adding a parameter was not reported:\n%s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const logFormatText string = "text"
+const logFormatJSON string = "json"
+
+const warningFormatText string = "text"
+const warningFormatGitHub string = "github"
+
+// leveledLogger writes diagnostic output, such as warnings, either as plain
+// text or as one JSON object per line.
+type leveledLogger struct {
+	out    io.Writer
+	format string
+
+	// warningFormat, when it is "github", writes warnings as GitHub Actions
+	// annotations regardless of format.
+	warningFormat string
+
+	// file is the chart that warnings are annotated with.
+	file string
+
+	// verbose enables messages at the debug level.
+	verbose bool
+}
+
+// logEntry is the structure of each line written in the json log format.
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// logger is where all diagnostic output is sent. It writes to stderr so that
+// it never mixes with generated content.
+var logger = &leveledLogger{out: os.Stderr, format: logFormatText, warningFormat: warningFormatText}
+
+// setFormat changes the output format, which must be either "text" or "json".
+func (l *leveledLogger) setFormat(format string) error {
+	switch format {
+	case logFormatText, logFormatJSON:
+		l.format = format
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q: must be %s or %s", format, logFormatText, logFormatJSON)
+}
+
+// setWarningFormat changes how warnings are written, which must be either
+// "text" or "github".
+func (l *leveledLogger) setWarningFormat(format string) error {
+	switch format {
+	case warningFormatText, warningFormatGitHub:
+		l.warningFormat = format
+		return nil
+	}
+	return fmt.Errorf("invalid warning format %q: must be %s or %s", format, warningFormatText, warningFormatGitHub)
+}
+
+// Errorf logs a message at the error level.
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.log("error", fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a message at the warning level.
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	l.log("warning", fmt.Sprintf(format, args...))
+}
+
+// Debugf logs a message at the debug level, which is only written in verbose
+// mode.
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	if l.verbose {
+		l.log("debug", fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof logs a message at the info level.
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	l.log("info", fmt.Sprintf(format, args...))
+}
+
+func (l *leveledLogger) log(level, message string) {
+	if level == "warning" && l.warningFormat == warningFormatGitHub {
+		fmt.Fprintln(l.out, githubAnnotation(level, l.file, message))
+		return
+	}
+	if l.format == logFormatJSON {
+		data, err := json.Marshal(logEntry{
+			Time:    time.Now().UTC().Format(time.RFC3339),
+			Level:   level,
+			Message: message,
+		})
+		if err == nil {
+			fmt.Fprintln(l.out, string(data))
+			return
+		}
+	}
+	if level == "info" {
+		fmt.Fprintln(l.out, message)
+		return
+	}
+	fmt.Fprintf(l.out, "%s: %s\n", level, message)
+}
+
+// githubAnnotation formats a message as a GitHub Actions workflow command,
+// such as "::warning file=chart.tgz::message", escaping the characters that
+// would otherwise end the property or the command.
+func githubAnnotation(level, file, message string) string {
+	message = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(message)
+	if len(file) == 0 {
+		return fmt.Sprintf("::%s::%s", level, message)
+	}
+	file = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(file)
+	return fmt.Sprintf("::%s file=%s::%s", level, file, message)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &leveledLogger{out: &buf, format: logFormatText, warningFormat: warningFormatText, verbose: true}
+	err := l.setFormat(logFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Warnf("%s not found", "values.yaml")
+	l.Infof("verified %s", "chart.tgz")
+	l.Debugf("read %d bytes", 12)
+	l.Errorf("%d of %d charts could not be converted", 1, 2)
+
+	want := []logEntry{
+		{Level: "warning", Message: "values.yaml not found"},
+		{Level: "info", Message: "verified chart.tgz"},
+		{Level: "debug", Message: "read 12 bytes"},
+		{Level: "error", Message: "1 of 2 charts could not be converted"},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var entry logEntry
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("line %d is not JSON: %v: %s", i, err, line)
+		}
+		if entry.Level != want[i].Level || entry.Message != want[i].Message {
+			t.Errorf("line %d: got level %q and message %q, want %q and %q", i, entry.Level, entry.Message, want[i].Level, want[i].Message)
+		}
+		if len(entry.Time) == 0 {
+			t.Errorf("line %d has no time: %s", i, line)
+		}
+	}
+}
+
+func TestLoggerErrorText(t *testing.T) {
+	var buf bytes.Buffer
+	l := &leveledLogger{out: &buf, format: logFormatText, warningFormat: warningFormatGitHub}
+	l.Errorf("could not get values from helm chart: %s", "no Chart.yaml")
+	// only warnings become annotations
+	if want := "error: could not get values from helm chart: no Chart.yaml\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLoggerSetFormatInvalid(t *testing.T) {
+	l := &leveledLogger{out: &bytes.Buffer{}, format: logFormatText}
+	if err := l.setFormat("xml"); err == nil {
+		t.Error("setFormat accepted xml")
+	}
+	if l.format != logFormatText {
+		t.Errorf("got format %q after an invalid one, want %q", l.format, logFormatText)
+	}
+}
+
+func TestGithubAnnotation(t *testing.T) {
+	for _, tc := range []struct {
+		file    string
+		message string
+		want    string
+	}{
+		{"", "values.yaml not found", "::warning::values.yaml not found"},
+		{"redis-1.1.12.tgz", "values.yaml not found", "::warning file=redis-1.1.12.tgz::values.yaml not found"},
+		{"", "100% done\nnext line\r", "::warning::100%25 done%0Anext line%0D"},
+		{"charts/a:b,c.tgz", "bad", "::warning file=charts/a%3Ab%2Cc.tgz::bad"},
+	} {
+		if got := githubAnnotation("warning", tc.file, tc.message); got != tc.want {
+			t.Errorf("githubAnnotation(%q, %q) = %q, want %q", tc.file, tc.message, got, tc.want)
+		}
+	}
+}
+
+func TestLoggerGithubWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	l := &leveledLogger{out: &buf, format: logFormatJSON, warningFormat: warningFormatText, file: "redis-1.1.12.tgz"}
+	err := l.setWarningFormat(warningFormatGitHub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Warnf("chart has no icon")
+	l.Infof("done")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), buf.String())
+	}
+	// warnings are annotations even in the json format, other levels are not
+	if want := "::warning file=redis-1.1.12.tgz::chart has no icon"; lines[0] != want {
+		t.Errorf("got warning %q, want %q", lines[0], want)
+	}
+	if !strings.HasPrefix(lines[1], "{") {
+		t.Errorf("got info line %q, want JSON", lines[1])
+	}
+
+	if err := l.setWarningFormat("gitlab"); err == nil {
+		t.Error("setWarningFormat accepted gitlab")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// provenanceSuffix is appended to a chart's filename to name the provenance
+// file that "helm package --sign" writes next to it.
+const provenanceSuffix string = ".prov"
+
+// defaultKeyring returns the keyring that helm also uses by default.
+func defaultKeyring() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// verifyProvenance checks that provFile is signed by a key in keyring and that
+// the sha256 digest it records for the chart matches the chart file. It
+// returns the identity of the signer.
+func verifyProvenance(chartFile, provFile, keyring string) (string, error) {
+	data, err := ioutil.ReadFile(provFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("%s is not a signed provenance file", provFile)
+	}
+
+	ring, err := readKeyring(keyring)
+	if err != nil {
+		return "", fmt.Errorf("keyring %s: %v", keyring, err)
+	}
+	signer, err := openpgp.CheckDetachedSignature(ring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return "", fmt.Errorf("%s: signature is not valid: %v", provFile, err)
+	}
+
+	expected, err := provenanceDigest(block.Plaintext, filepath.Base(chartFile))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", provFile, err)
+	}
+	actual, err := fileDigest(chartFile)
+	if err != nil {
+		return "", err
+	}
+	if actual != expected {
+		return "", fmt.Errorf("%s has digest sha256:%s, but %s records sha256:%s", chartFile, actual, provFile, expected)
+	}
+
+	identities := make([]string, 0, len(signer.Identities))
+	for name := range signer.Identities {
+		identities = append(identities, name)
+	}
+	sort.Strings(identities)
+	if len(identities) == 0 {
+		return fmt.Sprintf("key %X", signer.PrimaryKey.KeyId), nil
+	}
+	return identities[0], nil
+}
+
+// readKeyring reads a binary or ASCII-armored public keyring.
+func readKeyring(filename string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err == nil {
+		return ring, nil
+	}
+	return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+}
+
+// provenanceDigest returns the hex sha256 digest that a provenance file's
+// signed body records for the chart called name. The body is the chart's
+// Chart.yaml and a files section, as separate YAML documents.
+func provenanceDigest(body []byte, name string) (string, error) {
+	docs := strings.Split(string(body), "\n...\n")
+	if len(docs) < 2 {
+		return "", errors.New("no files section in provenance")
+	}
+	var parsed struct {
+		Files map[string]string `yaml:"files"`
+	}
+	err := yaml.Unmarshal([]byte(docs[len(docs)-1]), &parsed)
+	if err != nil {
+		return "", err
+	}
+	digest, ok := parsed.Files[name]
+	if !ok {
+		return "", fmt.Errorf("no digest recorded for %s", name)
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unsupported digest %q for %s", digest, name)
+	}
+	return strings.TrimPrefix(digest, "sha256:"), nil
+}
+
+// fileDigest returns the hex sha256 digest of the file at filename.
+func fileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
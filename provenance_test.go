@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signProvenance returns a provenance file for the chart called name with the
+// given digest, clear-signed by signer the way "helm package --sign" does.
+func signProvenance(t *testing.T, signer *openpgp.Entity, name, digest string) []byte {
+	body := chartYaml("redis", "1.0.0") + "\n...\nfiles:\n  " + name + ": sha256:" + digest + "\n"
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte(body))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeKeyring writes the public keys of entities to filename, armored if
+// armored is true.
+func writeKeyring(t *testing.T, filename string, armored bool, entities ...*openpgp.Entity) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var aw io.WriteCloser
+	if armored {
+		var err error
+		aw, err = armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = aw
+	}
+	for _, e := range entities {
+		if err := e.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if aw != nil {
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filename, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyProvenance(t *testing.T) {
+	signer, err := openpgp.NewEntity("Test Signer", "", "t@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Someone Else", "", "e@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	chart := writeChart(t, dir, "redis-1.0.0.tgz",
+		tarEntry{"redis/Chart.yaml", chartYaml("redis", "1.0.0")},
+		tarEntry{"redis/values.yaml", "port: 6379\n"})
+	digest, err := fileDigest(chart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := filepath.Join(dir, "pubring.gpg")
+	writeKeyring(t, keyring, false, signer)
+	armoredKeyring := filepath.Join(dir, "pubring.asc")
+	writeKeyring(t, armoredKeyring, true, signer)
+
+	for _, tc := range []struct {
+		name    string
+		prov    []byte
+		keyring string
+		wantErr string
+	}{
+		{"signed", signProvenance(t, signer, "redis-1.0.0.tgz", digest), keyring, ""},
+		{"armored keyring", signProvenance(t, signer, "redis-1.0.0.tgz", digest), armoredKeyring, ""},
+		{"unknown signer", signProvenance(t, other, "redis-1.0.0.tgz", digest), keyring, "signature is not valid"},
+		{"digest mismatch", signProvenance(t, signer, "redis-1.0.0.tgz", strings.Repeat("0", 64)), keyring, "but " + chart + ".prov records sha256:" + strings.Repeat("0", 64)},
+		{"other chart", signProvenance(t, signer, "mariadb-1.0.0.tgz", digest), keyring, "no digest recorded for redis-1.0.0.tgz"},
+		{"unsigned", []byte(chartYaml("redis", "1.0.0")), keyring, "is not a signed provenance file"},
+		{"missing keyring", signProvenance(t, signer, "redis-1.0.0.tgz", digest), filepath.Join(dir, "missing.gpg"), "keyring " + filepath.Join(dir, "missing.gpg")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provFile := chart + provenanceSuffix
+			err := ioutil.WriteFile(provFile, tc.prov, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity, err := verifyProvenance(chart, provFile, tc.keyring)
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity != "Test Signer <t@example.com>" {
+				t.Errorf("got signer %q", identity)
+			}
+		})
+	}
+}
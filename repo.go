@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// repoIndex is the part of a helm repository's index.yaml that is needed to
+// find a chart's download URL.
+type repoIndex struct {
+	Entries map[string][]repoChartVersion `yaml:"entries"`
+}
+
+// repoChartVersion is one version of a chart listed in a repository index.
+type repoChartVersion struct {
+	Version string   `yaml:"version"`
+	URLs    []string `yaml:"urls"`
+}
+
+// resolveRepoChart looks up chart in the index of the helm repository at
+// repoURL and returns the URL its tarball can be downloaded from. An empty
+// version selects the latest release, ignoring pre-releases unless there is
+// nothing else.
+func resolveRepoChart(repoURL, chart, version string) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(repoURL, "/") + "/")
+	if err != nil {
+		return "", fmt.Errorf("invalid repository URL %s: %v", repoURL, err)
+	}
+	index, err := fetchRepoIndex(repoURL, base.ResolveReference(&url.URL{Path: "index.yaml"}).String())
+	if err != nil {
+		return "", err
+	}
+
+	versions, ok := index.Entries[chart]
+	if !ok || len(versions) == 0 {
+		return "", fmt.Errorf("chart %q not found in repository %s", chart, repoURL)
+	}
+	selected, ok := selectChartVersion(versions, version)
+	if !ok {
+		available := make([]string, 0, len(versions))
+		for _, v := range versions {
+			available = append(available, v.Version)
+		}
+		return "", fmt.Errorf("version %s of chart %q is not available in repository %s; available versions: %s", version, chart, repoURL, strings.Join(available, ", "))
+	}
+	if len(selected.URLs) == 0 {
+		return "", fmt.Errorf("version %s of chart %q in repository %s has no download URL", selected.Version, chart, repoURL)
+	}
+
+	// index URLs may be relative to the repository
+	ref, err := url.Parse(selected.URLs[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid download URL %q for chart %q: %v", selected.URLs[0], chart, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// maxIndexSize is the largest repository index that is read.
+const maxIndexSize = 64 << 20
+
+// fetchRepoIndex downloads and parses the index.yaml at indexURL of the
+// repository at repoURL. Only a failure to reach the repository at all is
+// reported as it being unreachable.
+func fetchRepoIndex(repoURL, indexURL string) (repoIndex, error) {
+	var index repoIndex
+	resp, err := httpClient.Get(indexURL)
+	if err != nil {
+		return index, fmt.Errorf("repository %s is unreachable: %v", repoURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return index, fmt.Errorf("repository %s has no index: fetching %s: server responded %s", repoURL, indexURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIndexSize+1))
+	if err != nil {
+		return index, fmt.Errorf("repository %s is unreachable: fetching %s: %v", repoURL, indexURL, err)
+	}
+	if len(data) > maxIndexSize {
+		return index, fmt.Errorf("repository %s has an index larger than %d bytes", repoURL, maxIndexSize)
+	}
+	err = yaml.Unmarshal(data, &index)
+	if err != nil {
+		return index, fmt.Errorf("repository %s has an invalid index: %s is not a repository index: %v", repoURL, indexURL, err)
+	}
+	return index, nil
+}
+
+// selectChartVersion returns the entry for version, with or without a leading
+// "v", or the latest version if version is empty.
+func selectChartVersion(versions []repoChartVersion, version string) (repoChartVersion, bool) {
+	if len(version) > 0 {
+		for _, v := range versions {
+			if strings.TrimPrefix(v.Version, "v") == strings.TrimPrefix(version, "v") {
+				return v, true
+			}
+		}
+		return repoChartVersion{}, false
+	}
+
+	sorted := append([]repoChartVersion(nil), versions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareVersions(sorted[i].Version, sorted[j].Version) > 0
+	})
+	for _, v := range sorted {
+		if !strings.Contains(v.Version, "-") {
+			return v, true
+		}
+	}
+	return sorted[0], true
+}
+
+// compareVersions compares two semantic versions, returning a negative number
+// if a is older than b, a positive number if it is newer and zero if they are
+// equal. Build metadata is ignored, and pre-release identifiers are compared
+// as plain strings.
+func compareVersions(a, b string) int {
+	a = strings.SplitN(strings.TrimPrefix(a, "v"), "+", 2)[0]
+	b = strings.SplitN(strings.TrimPrefix(b, "v"), "+", 2)[0]
+	aRelease := strings.SplitN(a, "-", 2)
+	bRelease := strings.SplitN(b, "-", 2)
+
+	aParts := strings.Split(aRelease[0], ".")
+	bParts := strings.Split(bRelease[0], ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y int
+		if i < len(aParts) {
+			x, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			y, _ = strconv.Atoi(bParts[i])
+		}
+		if x != y {
+			return x - y
+		}
+	}
+
+	// a release is newer than any of its pre-releases
+	switch {
+	case len(aRelease) == 1 && len(bRelease) == 1:
+		return 0
+	case len(aRelease) == 1:
+		return 1
+	case len(bRelease) == 1:
+		return -1
+	}
+	return strings.Compare(aRelease[1], bRelease[1])
+}
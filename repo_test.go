@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int // the sign of the result
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"1.0.0+build.1", "1.0.0+build.2", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.0.1", "1.0.0", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+	} {
+		got := compareVersions(tc.a, tc.b)
+		if sign(got) != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want its sign to be %d", tc.a, tc.b, got, tc.want)
+		}
+		if sign(compareVersions(tc.b, tc.a)) != -tc.want {
+			t.Errorf("compareVersions(%q, %q) is not the reverse of compareVersions(%q, %q)", tc.b, tc.a, tc.a, tc.b)
+		}
+	}
+}
+
+// sign returns -1, 0 or 1 depending on the sign of n.
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestSelectChartVersion(t *testing.T) {
+	versions := []repoChartVersion{
+		{Version: "1.9.0"},
+		{Version: "2.0.0-rc.1"},
+		{Version: "1.10.0"},
+		{Version: "v1.2.0"},
+	}
+	for _, tc := range []struct {
+		versions []repoChartVersion
+		version  string
+		want     string
+		wantOK   bool
+	}{
+		{versions, "", "1.10.0", true},
+		{versions, "1.9.0", "1.9.0", true},
+		{versions, "v1.9.0", "1.9.0", true},
+		{versions, "1.2.0", "v1.2.0", true},
+		{versions, "2.0.0-rc.1", "2.0.0-rc.1", true},
+		{versions, "3.0.0", "", false},
+		// only pre-releases are chosen when there is nothing else
+		{[]repoChartVersion{{Version: "1.0.0-rc.1"}, {Version: "1.0.0-rc.2"}}, "", "1.0.0-rc.2", true},
+	} {
+		got, ok := selectChartVersion(tc.versions, tc.version)
+		if ok != tc.wantOK || got.Version != tc.want {
+			t.Errorf("selectChartVersion(%q) = %q, %v, want %q, %v", tc.version, got.Version, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestResolveRepoChart(t *testing.T) {
+	index := `apiVersion: v1
+entries:
+  redis:
+  - version: 1.1.13
+    urls:
+    - charts/redis-1.1.13.tgz
+  - version: 1.1.12
+    urls:
+    - https://mirror.example.com/redis-1.1.12.tgz
+  nourl:
+  - version: 1.0.0
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/index.yaml":
+			w.Write([]byte(index))
+		case "/broken/index.yaml":
+			w.Write([]byte("entries: [not, a, map"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	repo := server.URL + "/repo"
+
+	for _, tc := range []struct {
+		repo, chart, version string
+		want                 string
+		wantErr              string
+	}{
+		{repo, "redis", "", server.URL + "/repo/charts/redis-1.1.13.tgz", ""},
+		{repo + "/", "redis", "1.1.12", "https://mirror.example.com/redis-1.1.12.tgz", ""},
+		{repo, "redis", "2.0.0", "", "available versions: 1.1.13, 1.1.12"},
+		{repo, "mariadb", "", "", `chart "mariadb" not found in repository`},
+		{repo, "nourl", "", "", "has no download URL"},
+		{server.URL + "/missing", "redis", "", "", "has no index: fetching " + server.URL + "/missing/index.yaml: server responded 404"},
+		{server.URL + "/broken", "redis", "", "", "has an invalid index"},
+		{"http://127.0.0.1:1", "redis", "", "", "is unreachable"},
+	} {
+		got, err := resolveRepoChart(tc.repo, tc.chart, tc.version)
+		if len(tc.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("resolving %s %s from %s: got error %v, want one containing %q", tc.chart, tc.version, tc.repo, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolving %s %s from %s: %v", tc.chart, tc.version, tc.repo, err)
+		} else if got != tc.want {
+			t.Errorf("resolving %s %s from %s: got %s, want %s", tc.chart, tc.version, tc.repo, got, tc.want)
+		}
+	}
+}